@@ -0,0 +1,245 @@
+package myproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type AccessLogFormat int
+
+const (
+	CommonLogFormat AccessLogFormat = iota
+	CombinedLogFormat
+	JSONLogFormat
+)
+
+// AccessEntry is one completed exchange: a plain or MITM'd request, or a
+// CONNECT tunnel once it is closed.
+type AccessEntry struct {
+	Time      time.Time     `json:"time"`
+	Client    string        `json:"client"`
+	User      string        `json:"user,omitempty"`
+	Method    string        `json:"method"`
+	URL       string        `json:"url"`
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	BytesIn   int64         `json:"bytes_in"`
+	BytesOut  int64         `json:"bytes_out"`
+	Duration  time.Duration `json:"duration_ns"`
+	Upstream  string        `json:"upstream,omitempty"`
+	Action    string        `json:"action,omitempty"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+	Session   int64         `json:"session"`
+	RequestID string        `json:"request_id,omitempty"`
+	Timing    Timing        `json:"timing"`
+}
+
+// AccessLog writes one line per AccessEntry, separately from the debug log.
+// Common and Combined follow the Apache formats, JSON has all the fields.
+// Every line is a single Write, so that w can be a *RotatingFile, a
+// *syslog.Writer or any io.Writer.
+type AccessLog struct {
+	Format AccessLogFormat
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewAccessLog(w io.Writer, format AccessLogFormat) *AccessLog {
+	return &AccessLog{Format: format, w: w}
+}
+
+func (l *AccessLog) Log(e *AccessEntry) error {
+	var line []byte
+	switch l.Format {
+	case JSONLogFormat:
+		var err error
+		if line, err = json.Marshal(e); err != nil {
+			return err
+		}
+		line = append(line, '\n')
+	default:
+		user := e.User
+		if user == "" {
+			user = "-"
+		}
+		status := "-"
+		if e.Status != 0 {
+			status = strconv.Itoa(e.Status)
+		}
+		size := "-"
+		if e.BytesOut != 0 {
+			size = strconv.FormatInt(e.BytesOut, 10)
+		}
+		s := fmt.Sprintf("%s - %s [%s] %q %s %s", e.Client, user, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method+" "+e.URL+" "+e.Proto, status, size)
+		if l.Format == CombinedLogFormat {
+			s += fmt.Sprintf(" %q %q", e.Referer, e.UserAgent)
+		}
+		line = []byte(s + "\n")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(line)
+	return err
+}
+
+// complete records the end of an exchange in the access log and its trace.
+func (proxy *ProxyHttpServer) complete(ctx *ProxyCtx, status int, bytesOut int64) {
+	if !atomic.CompareAndSwapInt32(&ctx.completed, 0, 1) {
+		return
+	}
+	proxy.sessions.done(ctx)
+	defer ctx.cancelContext()
+	proxy.logAccess(ctx, status, bytesOut)
+	if err := ctx.trace.finish(ctx.Req, status, ctx.Error); err != nil {
+		ctx.Warnf("Cannot export spans: %v", err)
+	}
+	proxy.runCompleteHooks(ctx)
+}
+
+// abandon completes the exchange of ctx with the status it got to, for the
+// paths that give up on the client without completing it.
+func (proxy *ProxyHttpServer) abandon(ctx *ProxyCtx) {
+	proxy.complete(ctx, ctx.status, atomic.LoadInt64(&ctx.bytesOut))
+}
+
+func (proxy *ProxyHttpServer) logAccess(ctx *ProxyCtx, status int, bytesOut int64) {
+	if proxy.AccessLog == nil || ctx.Req == nil {
+		return
+	}
+	req := ctx.Req
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	e := &AccessEntry{
+		Time:      ctx.start,
+		Client:    client,
+		User:      ctx.user,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Proto:     req.Proto,
+		Status:    status,
+		BytesIn:   atomic.LoadInt64(&ctx.bytesIn),
+		BytesOut:  bytesOut,
+		Duration:  time.Since(ctx.start),
+		Upstream:  ctx.upstream,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+		Session:   ctx.Session,
+		RequestID: ctx.RequestID,
+		Timing:    ctx.Timing(),
+	}
+	if req.Method == http.MethodConnect {
+		e.URL = req.URL.Host
+	}
+	if connect := ctx.ConnectCtx; connect != nil {
+		ctx = connect
+	}
+	if ctx.connectSet {
+		e.Action = ctx.connectAction.String()
+	}
+	if err := proxy.AccessLog.Log(e); err != nil {
+		ctx.Warnf("Cannot write access log: %v", err)
+	}
+}
+
+func proxyUser(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	authz := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	user, _, _ := authz.BasicAuth()
+	return user
+}
+
+// RotatingFile is an io.WriteCloser appending to a file, which is renamed
+// with a .1 suffix, the previous .1 to .2 and so on, once it would grow
+// past MaxBytes. At most MaxBackups old files are kept. When the file cannot
+// be moved, writes go on in it and return the error.
+type RotatingFile struct {
+	Path       string
+	MaxBytes   int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func OpenRotatingFile(path string, maxBytes int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{Path: path, MaxBytes: maxBytes, MaxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", r.Path, r.MaxBackups))
+	for i := r.MaxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.Path, i), fmt.Sprintf("%s.%d", r.Path, i+1))
+	}
+	var err error
+	if r.MaxBackups > 0 {
+		err = os.Rename(r.Path, r.Path+".1")
+	} else {
+		err = os.Remove(r.Path)
+	}
+	if err != nil {
+		// keep appending to the file that could not be moved
+		if oerr := r.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var rotateErr error
+	if r.MaxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.MaxBytes {
+		rotateErr = r.rotate()
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,169 @@
+package myproxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+// wait returns the lines written so far once there is one, as the proxy logs
+// an exchange after the client got the whole response.
+func (s *syncBuffer) wait() string {
+	deadline := time.Now().Add(2 * time.Second)
+	for s.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s.String()
+}
+
+func TestAccessLogCommon(t *testing.T) {
+	buf := &syncBuffer{}
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.AccessLog = myproxy.NewAccessLog(buf, myproxy.CommonLogFormat)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/bobo", nil)
+	req.SetBasicAuth("alice", "secret")
+	req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	line := buf.wait()
+	expected := `"GET ` + srv.URL + `/bobo HTTP/1.1" 200 4`
+	if !strings.HasPrefix(line, "127.0.0.1 - alice [") || !strings.Contains(line, expected) {
+		t.Errorf("Expected a common log line for alice with %q, got %q", expected, line)
+	}
+}
+
+func TestAccessLogJSONMitm(t *testing.T) {
+	buf := &syncBuffer{}
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.AccessLog = myproxy.NewAccessLog(buf, myproxy.JSONLogFormat)
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(https.URL+"/bobo", client, t)
+
+	var e myproxy.AccessEntry
+	if err := json.Unmarshal([]byte(strings.SplitN(buf.wait(), "\n", 2)[0]), &e); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if e.Action != "mitm" || e.Status != 200 || e.BytesOut != 4 || e.URL != https.URL+"/bobo" {
+		t.Errorf("Unexpected entry for MITM'd request %+v", e)
+	}
+	if e.Upstream != https.Listener.Addr().String() || e.RequestID == "" || e.Session == 0 {
+		t.Errorf("Expected upstream, request id and session in %+v", e)
+	}
+}
+
+func TestAccessLogTunnel(t *testing.T) {
+	buf := &syncBuffer{}
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.AccessLog = myproxy.NewAccessLog(buf, myproxy.JSONLogFormat)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(https.URL+"/bobo", client, t)
+	client.Transport.(*http.Transport).CloseIdleConnections()
+
+	var e myproxy.AccessEntry
+	if err := json.Unmarshal([]byte(buf.wait()), &e); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if e.Method != "CONNECT" || e.Action != "accept" || e.URL != https.Listener.Addr().String() || e.Status != 200 {
+		t.Errorf("Unexpected entry for tunnel %+v", e)
+	}
+	if e.BytesIn == 0 || e.BytesOut == 0 {
+		t.Errorf("Expected tunnel bytes to be counted %+v", e)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	f, err := myproxy.OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	for suffix, expected := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		if b, _ := ioutil.ReadFile(path + suffix); string(b) != expected {
+			t.Errorf("Expected %q in %s, got %q", expected, path+suffix, b)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Expected only two backups to be kept")
+	}
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	// a directory in the way of the backup
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := myproxy.OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("second\n")); err == nil {
+		t.Error("Expected the failed rotation to be reported")
+	}
+	if _, err := f.Write([]byte("third\n")); err == nil {
+		t.Error("Expected the rotation to be tried again")
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "first\nsecond\nthird\n" {
+		t.Errorf("Expected the log to go on in %s, got %q", path, b)
+	}
+}
@@ -1,6 +1,9 @@
 package myproxy
 
-import "net/http"
+import (
+	"net"
+	"net/http"
+)
 
 type HttpsHandler interface {
 	HandleConnect(req string, ctx *ProxyCtx) (*ConnectAction, string)
@@ -14,12 +17,21 @@ type RespHandler interface {
 	Handle(resp *http.Response, ctx *ProxyCtx) *http.Response
 }
 
+// TunnelHandler sees the client connection of CONNECT tunnels and websockets
+// and can wrap it. Returning nil refuses the tunnel: the client is answered
+// with ctx.Resp, or a 403 when it is nil, before anything is dialed.
+type TunnelHandler interface {
+	HandleTunnel(client net.Conn, ctx *ProxyCtx) net.Conn
+}
+
 type FuncReqHandler func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response)
 
 type FuncRespHandler func(resp *http.Response, ctx *ProxyCtx) *http.Response
 
 type FuncHttpsHandler func(host string, ctx *ProxyCtx) (*ConnectAction, string)
 
+type FuncTunnelHandler func(client net.Conn, ctx *ProxyCtx) net.Conn
+
 func (f FuncReqHandler) Handle(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
 	return f(req, ctx)
 }
@@ -30,3 +42,7 @@ func (f FuncRespHandler) Handle(resp *http.Response, ctx *ProxyCtx) *http.Respon
 func (f FuncHttpsHandler) HandleConnect(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 	return f(host, ctx)
 }
+
+func (f FuncTunnelHandler) HandleTunnel(client net.Conn, ctx *ProxyCtx) net.Conn {
+	return f(client, ctx)
+}
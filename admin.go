@@ -0,0 +1,266 @@
+package myproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessions are the plain requests and CONNECTs being served, which the
+// admin API lists and kills. What is listed is copied when a session starts,
+// as handlers are free to change the request.
+type sessions struct {
+	mu sync.Mutex
+	m  map[int64]*session
+}
+
+type session struct {
+	ctx                       *ProxyCtx
+	client, method, url, user string
+	action                    string
+	idle                      bool
+	killers                   []func()
+	inflight                  *session
+}
+
+func newSession(ctx *ProxyCtx) *session {
+	req := ctx.Req
+	s := &session{ctx: ctx, client: req.RemoteAddr, method: req.Method, url: req.URL.String(), user: ctx.user}
+	if req.Method == http.MethodConnect {
+		s.url = req.URL.Host
+	}
+	return s
+}
+
+func (s *sessions) add(ctx *ProxyCtx, kill func()) {
+	entry := newSession(ctx)
+	if kill != nil {
+		entry.killers = append(entry.killers, kill)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[int64]*session)
+	}
+	s.m[ctx.Session] = entry
+}
+
+func (s *sessions) onKill(ctx *ProxyCtx, kill func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry := s.m[ctx.Session]; entry != nil {
+		entry.killers = append(entry.killers, kill)
+	}
+}
+
+func (s *sessions) setAction(ctx *ProxyCtx, action ConnectActionLiteral) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry := s.m[ctx.Session]; entry != nil {
+		entry.action = action.String()
+	}
+}
+
+// setInflight shows ctx as the request being served in its CONNECT.
+func (s *sessions) setInflight(ctx *ProxyCtx) {
+	inflight := newSession(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry := s.m[ctx.ConnectCtx.Session]; entry != nil {
+		entry.inflight = inflight
+	}
+}
+
+// done forgets a session, or the request in flight in a CONNECT.
+func (s *sessions) done(ctx *ProxyCtx) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if connect := ctx.ConnectCtx; connect != nil {
+		if entry := s.m[connect.Session]; entry != nil && entry.inflight != nil && entry.inflight.ctx == ctx {
+			entry.inflight = nil
+		}
+		return
+	}
+	if entry := s.m[ctx.Session]; entry != nil && entry.ctx == ctx {
+		delete(s.m, ctx.Session)
+	}
+}
+
+func (s *sessions) kill(id int64) bool {
+	s.mu.Lock()
+	entry := s.m[id]
+	var killers []func()
+	if entry != nil {
+		killers = entry.killers
+	}
+	s.mu.Unlock()
+	for _, kill := range killers {
+		kill()
+	}
+	return entry != nil
+}
+
+// SessionInfo describes a request or CONNECT being served by the proxy.
+type SessionInfo struct {
+	Session  int64         `json:"session"`
+	Kind     string        `json:"kind"`
+	Action   string        `json:"action,omitempty"`
+	Client   string        `json:"client"`
+	User     string        `json:"user,omitempty"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Start    time.Time     `json:"start"`
+	Age      time.Duration `json:"age_ns"`
+	BytesIn  int64         `json:"bytes_in"`
+	BytesOut int64         `json:"bytes_out"`
+	Request  *SessionInfo  `json:"request,omitempty"`
+}
+
+func (s *session) info(now time.Time) *SessionInfo {
+	info := &SessionInfo{
+		Session:  s.ctx.Session,
+		Kind:     "request",
+		Action:   s.action,
+		Client:   s.client,
+		User:     s.user,
+		Method:   s.method,
+		URL:      s.url,
+		Start:    s.ctx.start,
+		Age:      now.Sub(s.ctx.start),
+		BytesIn:  atomic.LoadInt64(&s.ctx.bytesIn),
+		BytesOut: atomic.LoadInt64(&s.ctx.bytesOut),
+	}
+	if s.method == http.MethodConnect {
+		info.Kind = "tunnel"
+	}
+	if s.inflight != nil {
+		info.Request = s.inflight.info(now)
+	}
+	return info
+}
+
+// Sessions lists the requests and CONNECT tunnels being served, oldest
+// first, with the request in flight in MITM'd tunnels.
+func (proxy *ProxyHttpServer) Sessions() []*SessionInfo {
+	now := time.Now()
+	s := &proxy.sessions
+	s.mu.Lock()
+	infos := make([]*SessionInfo, 0, len(s.m))
+	for _, entry := range s.m {
+		infos = append(infos, entry.info(now))
+	}
+	s.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Session < infos[j].Session })
+	return infos
+}
+
+// KillSession closes the connections of a CONNECT tunnel, or cancels a
+// request. It returns false if no such session is being served.
+func (proxy *ProxyHttpServer) KillSession(id int64) bool {
+	return proxy.sessions.kill(id)
+}
+
+// Admin is an HTTP API to watch and manage a proxy:
+//
+//	GET    /sessions       lists the sessions being served
+//	GET    /sessions/{id}  shows one session
+//	DELETE /sessions/{id}  kills a session
+//	GET    /healthz        answers 200 while the proxy is running
+//	GET    /readyz         answers 200 if Ready returns nil and the proxy is
+//	                       not shutting down, 503 otherwise
+//
+// Serve it on a separate listener, or with Handler under a reserved path of
+// NonproxyHandler, keeping in mind anyone able to use the proxy can then
+// reach it.
+type Admin struct {
+	Proxy *ProxyHttpServer
+	Ready func() error
+}
+
+func NewAdmin(proxy *ProxyHttpServer) *Admin {
+	return &Admin{Proxy: proxy}
+}
+
+// Handler serves the API under prefix and hands any other request to next.
+func (a *Admin) Handler(prefix string, next http.Handler) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			if next == nil {
+				http.NotFound(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.StripPrefix(prefix, a).ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path := r.URL.Path; {
+	case path == "/healthz":
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	case path == "/readyz":
+		if a.Proxy.closing() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+			return
+		}
+		if a.Ready != nil {
+			if err := a.Ready(); err != nil {
+				writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "error": err.Error()})
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	case path == "/sessions":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, a.Proxy.Sessions())
+	case strings.HasPrefix(path, "/sessions/"):
+		id, err := strconv.ParseInt(strings.TrimPrefix(path, "/sessions/"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad session id", http.StatusBadRequest)
+			return
+		}
+		a.serveSession(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *Admin) serveSession(w http.ResponseWriter, r *http.Request, id int64) {
+	switch r.Method {
+	case http.MethodGet:
+		for _, info := range a.Proxy.Sessions() {
+			if info.Session == id {
+				writeJSON(w, http.StatusOK, info)
+				return
+			}
+		}
+	case http.MethodDelete:
+		if a.Proxy.KillSession(id) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.Error(w, "no such session", http.StatusNotFound)
+}
@@ -0,0 +1,172 @@
+package myproxy_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+// direct does not go through the proxy some tests set on http.DefaultClient
+var direct = &http.Client{}
+
+func listSessions(t *testing.T, admin *httptest.Server) []myproxy.SessionInfo {
+	resp, err := direct.Get(admin.URL + "/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var infos []myproxy.SessionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+	return infos
+}
+
+func waitSessions(t *testing.T, admin *httptest.Server, n int) []myproxy.SessionInfo {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		infos := listSessions(t, admin)
+		if len(infos) == n || time.Now().After(deadline) {
+			return infos
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func killSession(t *testing.T, admin *httptest.Server, id int64) int {
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/sessions/%d", admin.URL, id), nil)
+	resp, err := direct.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAdminKillTunnel(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	admin := httptest.NewServer(myproxy.NewAdmin(proxy))
+	defer admin.Close()
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	host := https.Listener.Addr().String()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT through proxy", err)
+	}
+
+	infos := waitSessions(t, admin, 1)
+	if len(infos) != 1 || infos[0].Kind != "tunnel" || infos[0].Action != "accept" || infos[0].URL != host {
+		t.Fatalf("Expected the tunnel to be listed, got %+v", infos)
+	}
+	if status := killSession(t, admin, infos[0].Session); status != http.StatusNoContent {
+		t.Fatal("Cannot kill tunnel", status)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Error("Expected killed tunnel to be closed, got", err)
+	}
+	if infos := waitSessions(t, admin, 0); len(infos) != 0 {
+		t.Errorf("Expected no sessions after kill, got %+v", infos)
+	}
+	if status := killSession(t, admin, infos[0].Session); status != http.StatusNotFound {
+		t.Error("Expected 404 killing a finished session, got", status)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestAdminKillRequest(t *testing.T) {
+	release := make(chan bool)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer origin.Close()
+	defer close(release)
+	proxy := myproxy.NewProxyHttpServer()
+	admin := httptest.NewServer(myproxy.NewAdmin(proxy))
+	defer admin.Close()
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, _ := client.Get(origin.URL + "/stuck")
+		done <- resp
+	}()
+	infos := waitSessions(t, admin, 1)
+	if len(infos) != 1 || infos[0].Kind != "request" || infos[0].URL != origin.URL+"/stuck" {
+		t.Fatalf("Expected the request to be listed, got %+v", infos)
+	}
+	killSession(t, admin, infos[0].Session)
+	select {
+	case resp := <-done:
+		if resp == nil || resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("Expected killed request to fail, got %v", resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Killed request still running")
+	}
+}
+
+func TestAdminHealth(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	a := myproxy.NewAdmin(proxy)
+	var notReady error = errors.New("warming up")
+	a.Ready = func() error { return notReady }
+	proxy.NonproxyHandler = a.Handler("/admin", proxy.NonproxyHandler)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/admin/healthz", 200},
+		{"/admin/readyz", 503},
+		{"/admin/sessions", 200},
+		{"/admin/nothing", 404},
+		{"/other", 500},
+	} {
+		resp, err := direct.Get(s.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("Expected %d for %s, got %d", tc.status, tc.path, resp.StatusCode)
+		}
+	}
+	notReady = nil
+	if resp, _ := direct.Get(s.URL + "/admin/readyz"); resp.StatusCode != 200 {
+		t.Error("Expected ready once Ready returns nil, got", resp.StatusCode)
+	}
+	if err := proxy.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := direct.Get(s.URL + "/admin/readyz"); resp.StatusCode != 503 {
+		t.Error("Expected not ready once shutting down, got", resp.StatusCode)
+	}
+}
@@ -0,0 +1,334 @@
+package myproxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// reqCond is a ReqCondition made of its two halves.
+type reqCond struct {
+	req  ReqConditionFunc
+	resp RespConditionFunc
+}
+
+func (c reqCond) HandleReq(req *http.Request, ctx *ProxyCtx) bool {
+	return c.req(req, ctx)
+}
+
+func (c reqCond) HandleResp(resp *http.Response, ctx *ProxyCtx) bool {
+	return c.resp(resp, ctx)
+}
+
+// And matches when all of conds match, the conditions passed to OnRequest
+// already are.
+func And(conds ...ReqCondition) ReqCondition {
+	return reqCond{
+		req: func(req *http.Request, ctx *ProxyCtx) bool {
+			for _, c := range conds {
+				if !c.HandleReq(req, ctx) {
+					return false
+				}
+			}
+			return true
+		},
+		resp: RespConditionFunc(AndResp(respConds(conds)...).HandleResp),
+	}
+}
+
+// Or matches when any of conds matches.
+func Or(conds ...ReqCondition) ReqCondition {
+	return reqCond{
+		req: func(req *http.Request, ctx *ProxyCtx) bool {
+			for _, c := range conds {
+				if c.HandleReq(req, ctx) {
+					return true
+				}
+			}
+			return false
+		},
+		resp: RespConditionFunc(OrResp(respConds(conds)...).HandleResp),
+	}
+}
+
+// Not matches when cond does not.
+func Not(cond ReqCondition) ReqCondition {
+	return reqCond{
+		req: func(req *http.Request, ctx *ProxyCtx) bool {
+			return !cond.HandleReq(req, ctx)
+		},
+		resp: RespConditionFunc(NotResp(cond).HandleResp),
+	}
+}
+
+func respConds(conds []ReqCondition) []RespCondition {
+	r := make([]RespCondition, len(conds))
+	for i, c := range conds {
+		r[i] = c
+	}
+	return r
+}
+
+func AndResp(conds ...RespCondition) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		for _, c := range conds {
+			if !c.HandleResp(resp, ctx) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func OrResp(conds ...RespCondition) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		for _, c := range conds {
+			if c.HandleResp(resp, ctx) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func NotResp(cond RespCondition) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		return !cond.HandleResp(resp, ctx)
+	})
+}
+
+// SrcIpIn matches requests from clients in the given IPv4 or IPv6 CIDR
+// ranges or addresses. It panics on invalid ranges, as regexp.MustCompile
+// does.
+func SrcIpIn(ranges ...string) ReqConditionFunc {
+	nets, err := parseIPNets(ranges)
+	if err != nil {
+		panic("myproxy: SrcIpIn: " + err.Error())
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return ipInNets(srcIP(req), nets)
+	}
+}
+
+func MethodIs(methods ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, m := range methods {
+			if strings.EqualFold(req.Method, m) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SchemeIs matches the scheme of request URLs, CONNECT requests have none.
+func SchemeIs(schemes ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, s := range schemes {
+			if strings.EqualFold(req.URL.Scheme, s) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// PortIs matches the destination port of requests, the default port of
+// their scheme when the URL has none.
+func PortIs(ports ...int) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		_, port := reqHost(req)
+		for _, p := range ports {
+			if port == p {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func HasHeader(name string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return len(req.Header.Values(name)) > 0
+	}
+}
+
+// HeaderMatches matches requests with a value of header name matching re.
+func HeaderMatches(name string, re *regexp.Regexp) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return anyMatches(re, req.Header.Values(name))
+	}
+}
+
+func anyMatches(re *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func HasCookie(name string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		_, err := req.Cookie(name)
+		return err == nil
+	}
+}
+
+func CookieMatches(name string, re *regexp.Regexp) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		c, err := req.Cookie(name)
+		return err == nil && re.MatchString(c.Value)
+	}
+}
+
+func HasQueryParam(name string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		_, ok := req.URL.Query()[name]
+		return ok
+	}
+}
+
+func QueryParamMatches(name string, re *regexp.Regexp) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return anyMatches(re, req.URL.Query()[name])
+	}
+}
+
+func UserAgentMatches(re *regexp.Regexp) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return re.MatchString(req.UserAgent())
+	}
+}
+
+// UserIs matches requests of the given proxy users, see ProxyCtx.User.
+func UserIs(users ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		user := ctx.User()
+		for _, u := range users {
+			if user != "" && user == u {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ReqBodyLarger matches requests declaring a body of more than n bytes,
+// requests of unknown length never match.
+func ReqBodyLarger(n int64) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return req.ContentLength > n
+	}
+}
+
+// StatusIn matches responses with a status from min to max included, for
+// instance StatusIn(500, 599).
+func StatusIn(min, max int) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && resp.StatusCode >= min && resp.StatusCode <= max
+	})
+}
+
+func StatusIs(codes ...int) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		if resp == nil {
+			return false
+		}
+		for _, c := range codes {
+			if resp.StatusCode == c {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func RespHasHeader(name string) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && len(resp.Header.Values(name)) > 0
+	})
+}
+
+func RespHeaderMatches(name string, re *regexp.Regexp) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && anyMatches(re, resp.Header.Values(name))
+	})
+}
+
+// RespBodyLarger matches responses declaring a body of more than n bytes,
+// responses of unknown length never match.
+func RespBodyLarger(n int64) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && resp.ContentLength > n
+	})
+}
+
+// SniffedContentTypeIs matches responses whose body looks like one of types
+// according to http.DetectContentType, whatever their Content-Type header
+// says. Only the first chunk the server sent is read, and put back, so that
+// streaming responses are not held up; event streams are never sniffed.
+func SniffedContentTypeIs(types ...string) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		if resp == nil || resp.Body == nil {
+			return false
+		}
+		sniffed := sniffContentType(resp)
+		if sniffed == "" {
+			return false
+		}
+		for _, typ := range types {
+			if sniffed == typ || strings.HasPrefix(sniffed, typ+";") {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// sniffedBody is a response body whose start was read to detect its type.
+type sniffedBody struct {
+	io.Reader
+	io.Closer
+	contentType string
+}
+
+func sniffContentType(resp *http.Response) string {
+	if b, ok := resp.Body.(*sniffedBody); ok {
+		return b.contentType
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt == "text/event-stream" {
+		return ""
+	}
+	head := make([]byte, 512)
+	var n int
+	var err error
+	for n == 0 && err == nil {
+		n, err = resp.Body.Read(head)
+	}
+	head = head[:n]
+	body := &sniffedBody{Reader: io.MultiReader(bytes.NewReader(head), resp.Body), Closer: resp.Body}
+	if err != nil && err != io.EOF {
+		body.Reader = io.MultiReader(bytes.NewReader(head), errReader{err})
+	}
+	body.contentType = http.DetectContentType(head)
+	resp.Body = body
+	return body.contentType
+}
+
+// sameBody reports whether body is orig, maybe re-wrapped by sniffing, so
+// that its length still holds.
+func sameBody(body, orig io.ReadCloser) bool {
+	if b, ok := body.(*sniffedBody); ok {
+		return b.Closer == orig
+	}
+	return body == orig
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
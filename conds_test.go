@@ -0,0 +1,241 @@
+package myproxy_test
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+func TestConditionCombinators(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://example.com/api", nil)
+	ctx := &myproxy.ProxyCtx{Req: req}
+	post := myproxy.ReqConditionFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) bool { return req.Method == "POST" })
+	example := myproxy.DstHostIs("example.com")
+	other := myproxy.DstHostIs("other.com")
+
+	for _, tc := range []struct {
+		name     string
+		cond     myproxy.ReqCondition
+		expected bool
+	}{
+		{"and", myproxy.And(post, example), true},
+		{"and other", myproxy.And(post, other), false},
+		{"or", myproxy.Or(other, example), true},
+		{"or none", myproxy.Or(other, myproxy.Not(post)), false},
+		{"not", myproxy.Not(other), true},
+		{"nested", myproxy.Not(myproxy.And(post, myproxy.Or(other, example))), false},
+		{"empty and", myproxy.And(), true},
+		{"empty or", myproxy.Or(), false},
+	} {
+		if m := tc.cond.HandleReq(req, ctx); m != tc.expected {
+			t.Errorf("%s: expected %v on request, got %v", tc.name, tc.expected, m)
+		}
+		if m := tc.cond.HandleResp(nil, ctx); m != tc.expected {
+			t.Errorf("%s: expected %v on response, got %v", tc.name, tc.expected, m)
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{"Content-Type": {"text/html"}}}
+	html := myproxy.ContentTypeIs("text/html")
+	if !myproxy.AndResp(html, example).HandleResp(resp, ctx) || myproxy.NotResp(html).HandleResp(resp, ctx) ||
+		!myproxy.OrResp(myproxy.ContentTypeIs("image/png"), html).HandleResp(resp, ctx) {
+		t.Error("Expected response combinators to combine response conditions")
+	}
+}
+
+func TestOrOnRequest(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest(myproxy.Or(myproxy.UrlIs("/a"), myproxy.UrlIs("/b"))).DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, myproxy.NewResponse(req, myproxy.ContentTypeText, http.StatusOK, "matched")
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for path, expected := range map[string]string{"/a": "matched", "/b": "matched", "/bobo": "bobo"} {
+		if r := string(getOrFail(srv.URL+path, client, t)); r != expected {
+			t.Errorf("Expected %q for %s, got %q", expected, path, r)
+		}
+	}
+}
+
+func TestBuiltinConditions(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://example.com/api?debug=1&id=42", strings.NewReader("0123456789"))
+	req.RemoteAddr = "[2001:db8::7]:5555"
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.Header.Set("X-Token", "abc123")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s-1"})
+	ctx := &myproxy.ProxyCtx{Req: req}
+	ctx.SetUser("alice")
+
+	for _, tc := range []struct {
+		name     string
+		cond     myproxy.ReqCondition
+		expected bool
+	}{
+		{"src in v6 range", myproxy.SrcIpIn("10.0.0.0/8", "2001:db8::/32"), true},
+		{"src not in range", myproxy.SrcIpIn("10.0.0.0/8", "192.168.1.1"), false},
+		{"src is v6", myproxy.SrcIpIs("2001:db8:0::7"), true},
+		{"src is other", myproxy.SrcIpIs("2001:db8::8"), false},
+		{"method", myproxy.MethodIs("GET", "post"), true},
+		{"other method", myproxy.MethodIs("GET"), false},
+		{"scheme", myproxy.SchemeIs("https"), true},
+		{"default port", myproxy.PortIs(443), true},
+		{"other port", myproxy.PortIs(80, 8443), false},
+		{"header", myproxy.HasHeader("x-token"), true},
+		{"missing header", myproxy.HasHeader("Authorization"), false},
+		{"header regexp", myproxy.HeaderMatches("X-Token", regexp.MustCompile(`^abc\d+$`)), true},
+		{"cookie", myproxy.HasCookie("session"), true},
+		{"missing cookie", myproxy.HasCookie("other"), false},
+		{"cookie regexp", myproxy.CookieMatches("session", regexp.MustCompile(`^s-`)), true},
+		{"query", myproxy.HasQueryParam("debug"), true},
+		{"missing query", myproxy.HasQueryParam("trace"), false},
+		{"query regexp", myproxy.QueryParamMatches("id", regexp.MustCompile(`^\d+$`)), true},
+		{"user agent", myproxy.UserAgentMatches(regexp.MustCompile(`^curl/`)), true},
+		{"user", myproxy.UserIs("bob", "alice"), true},
+		{"other user", myproxy.UserIs("bob"), false},
+		{"body larger", myproxy.ReqBodyLarger(5), true},
+		{"body not larger", myproxy.ReqBodyLarger(10), false},
+	} {
+		if m := tc.cond.HandleReq(req, ctx); m != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, m)
+		}
+	}
+
+	if myproxy.UserIs("").HandleReq(req, &myproxy.ProxyCtx{Req: req}) {
+		t.Error("Expected anonymous requests not to match an empty user")
+	}
+	req.ContentLength = -1
+	if myproxy.ReqBodyLarger(0).HandleReq(req, ctx) {
+		t.Error("Expected a body of unknown length not to match")
+	}
+}
+
+func TestBuiltinResponseConditions(t *testing.T) {
+	resp := &http.Response{StatusCode: 503, ContentLength: 2048, Header: http.Header{"Retry-After": {"120"}}}
+
+	for _, tc := range []struct {
+		name     string
+		cond     myproxy.RespCondition
+		expected bool
+	}{
+		{"status", myproxy.StatusIs(502, 503), true},
+		{"other status", myproxy.StatusIs(200), false},
+		{"status range", myproxy.StatusIn(500, 599), true},
+		{"other status range", myproxy.StatusIn(400, 499), false},
+		{"header", myproxy.RespHasHeader("retry-after"), true},
+		{"missing header", myproxy.RespHasHeader("Location"), false},
+		{"header regexp", myproxy.RespHeaderMatches("Retry-After", regexp.MustCompile(`^\d+$`)), true},
+		{"body larger", myproxy.RespBodyLarger(1024), true},
+		{"body not larger", myproxy.RespBodyLarger(4096), false},
+	} {
+		if m := tc.cond.HandleResp(resp, nil); m != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, m)
+		}
+		if tc.cond.HandleResp(nil, nil) {
+			t.Errorf("%s: expected no match without a response", tc.name)
+		}
+	}
+}
+
+func TestSniffedContentType(t *testing.T) {
+	body := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 1000)
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": {"text/plain"}},
+		Body:   ioutil.NopCloser(strings.NewReader(body)),
+	}
+	if !myproxy.SniffedContentTypeIs("image/png").HandleResp(resp, nil) {
+		t.Error("Expected the body to be sniffed as a PNG")
+	}
+	if myproxy.SniffedContentTypeIs("text/plain").HandleResp(resp, nil) {
+		t.Error("Expected the Content-Type header to be ignored")
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(b) != body {
+		t.Errorf("Expected the whole body after sniffing, got %d bytes, %v", len(b), err)
+	}
+
+	html := &http.Response{Body: ioutil.NopCloser(strings.NewReader("<html><body>hi"))}
+	if !myproxy.SniffedContentTypeIs("text/html").HandleResp(html, nil) {
+		t.Error("Expected a short HTML body to be sniffed as text/html")
+	}
+}
+
+func TestSniffedContentTypeStreams(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go io.WriteString(pw, "<html>")
+	stream := &http.Response{Body: pr}
+	done := make(chan bool, 1)
+	go func() { done <- myproxy.SniffedContentTypeIs("text/html").HandleResp(stream, nil) }()
+	select {
+	case matched := <-done:
+		if !matched {
+			t.Error("Expected the first chunk to be sniffed as text/html")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected sniffing not to wait for more than the first chunk")
+	}
+
+	events := &http.Response{
+		Header: http.Header{"Content-Type": {"text/event-stream"}},
+		Body:   pr,
+	}
+	if myproxy.SniffedContentTypeIs("text/plain").HandleResp(events, nil) {
+		t.Error("Expected event streams not to be sniffed")
+	}
+}
+
+func TestSniffedContentTypeKeepsLength(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnResponse(myproxy.SniffedContentTypeIs("text/plain")).DoFunc(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Sniffed", "text")
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "65536")
+		io.WriteString(w, strings.Repeat("x", 65536))
+	}))
+	defer target.Close()
+
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Sniffed") != "text" || resp.ContentLength != 65536 {
+		t.Errorf("Expected a sniffed response to keep its length, got %q %d", resp.Header.Get("X-Sniffed"), resp.ContentLength)
+	}
+}
+
+func TestUserIsOnProxy(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest(myproxy.UserIs("alice")).DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, myproxy.NewResponse(req, myproxy.ContentTypeText, http.StatusOK, "alice")
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for user, expected := range map[string]string{"alice": "alice", "bob": "bobo"} {
+		req, _ := http.NewRequest("GET", srv.URL+"/bobo", nil)
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":secret")))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != expected {
+			t.Errorf("Expected %q for %s, got %q", expected, user, b)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package myproxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// detached keeps the values of a context but not its cancellation, as the
+// context of a hijacked CONNECT request ends with its handler, long before
+// the tunnel does.
+type detached struct{ context.Context }
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+func (ctx *ProxyCtx) initContext(req *http.Request, connect *ProxyCtx) {
+	var base context.Context = context.Background()
+	switch {
+	case connect != nil:
+		base = connect.Context()
+	case req != nil && req.Method == "CONNECT":
+		base = detached{req.Context()}
+	case req != nil:
+		base = req.Context()
+	}
+	ctx.ctx, ctx.cancel = context.WithCancel(base)
+}
+
+// Context returns the context of the exchange. It is canceled once the client
+// connection closes, the exchange completes or its session is killed; MITM
+// requests inherit the context of their CONNECT. CONNECT and websocket dials
+// are made with it, upstream requests with it merged with their own context.
+func (ctx *ProxyCtx) Context() context.Context {
+	if ctx.ctx == nil {
+		return context.Background()
+	}
+	return ctx.ctx
+}
+
+// SetContext replaces the context of the exchange. c should be derived from
+// Context() to keep its cancellation.
+func (ctx *ProxyCtx) SetContext(c context.Context) {
+	ctx.ctx = c
+}
+
+// requestContext merges the context a request was given with the one of
+// its exchange: it ends with either, and has the values of both, those of
+// the request first.
+type requestContext struct {
+	req, exchange context.Context
+	done          <-chan struct{}
+}
+
+func mergeContexts(req, exchange context.Context) context.Context {
+	c := &requestContext{req: req, exchange: exchange}
+	switch {
+	case exchange.Done() == nil:
+		c.done = req.Done()
+	case req.Done() == nil:
+		c.done = exchange.Done()
+	default:
+		done := make(chan struct{})
+		c.done = done
+		if req.Err() != nil || exchange.Err() != nil {
+			close(done)
+			break
+		}
+		go func() {
+			select {
+			case <-req.Done():
+			case <-exchange.Done():
+			}
+			close(done)
+		}()
+	}
+	return c
+}
+
+func (c *requestContext) Deadline() (time.Time, bool) {
+	d, ok := c.req.Deadline()
+	if e, eok := c.exchange.Deadline(); eok && (!ok || e.Before(d)) {
+		return e, true
+	}
+	return d, ok
+}
+
+func (c *requestContext) Done() <-chan struct{} { return c.done }
+
+func (c *requestContext) Err() error {
+	select {
+	case <-c.done:
+	default:
+		return nil
+	}
+	if err := c.exchange.Err(); err != nil {
+		return err
+	}
+	return c.req.Err()
+}
+
+func (c *requestContext) Value(key interface{}) interface{} {
+	first, second := c.req, c.exchange
+	// context.Cause finds the canceled context through its values
+	if c.exchange.Err() != nil {
+		first, second = second, first
+	}
+	if v := first.Value(key); v != nil {
+		return v
+	}
+	return second.Value(key)
+}
+
+// WithDeadline makes the context of the exchange expire at d.
+func (ctx *ProxyCtx) WithDeadline(d time.Time) {
+	c, cancel := context.WithDeadline(ctx.Context(), d)
+	ctx.ctx = c
+	ctx.onDone(cancel)
+}
+
+// WithTimeout makes the context of the exchange expire after timeout.
+func (ctx *ProxyCtx) WithTimeout(timeout time.Duration) {
+	ctx.WithDeadline(time.Now().Add(timeout))
+}
+
+// WithValue adds a value to the context of the exchange, visible to later
+// handlers and to the upstream round trip.
+func (ctx *ProxyCtx) WithValue(key, val interface{}) {
+	ctx.ctx = context.WithValue(ctx.Context(), key, val)
+}
+
+func (ctx *ProxyCtx) onDone(f context.CancelFunc) {
+	prev := ctx.cancel
+	ctx.cancel = func() {
+		f()
+		if prev != nil {
+			prev()
+		}
+	}
+}
+
+// cancelContext releases the context of ctx once its exchange is over.
+func (ctx *ProxyCtx) cancelContext() {
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
+}
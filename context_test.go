@@ -0,0 +1,196 @@
+package myproxy_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+type ctxKey string
+
+func TestContextValueReachesRoundTrip(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.WithValue(ctxKey("tenant"), "acme")
+		ctx.RoundTripper = myproxy.RoundTripperFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Response, error) {
+			if v := req.Context().Value(ctxKey("tenant")); v != "acme" {
+				t.Errorf("Expected context value in round trip, got %v", v)
+			}
+			return myproxy.NewResponse(req, myproxy.ContentTypeText, http.StatusOK, "ok"), nil
+		})
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "ok" {
+		t.Error("Expected the round tripper response, got", r)
+	}
+}
+
+func TestContextOfRequestReachesRoundTrip(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.WithValue(ctxKey("tenant"), "acme")
+		c, cancel := context.WithCancel(context.WithValue(req.Context(), ctxKey("user"), "bob"))
+		cancel()
+		ctx.RoundTripper = myproxy.RoundTripperFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Response, error) {
+			c := req.Context()
+			if c.Value(ctxKey("tenant")) != "acme" || c.Value(ctxKey("user")) != "bob" {
+				t.Errorf("Expected the values of both contexts, got %v and %v", c.Value(ctxKey("tenant")), c.Value(ctxKey("user")))
+			}
+			if c.Err() != context.Canceled {
+				t.Error("Expected the cancellation of the request context, got", c.Err())
+			}
+			return myproxy.NewResponse(req, myproxy.ContentTypeText, http.StatusOK, "ok"), nil
+		})
+		return req.WithContext(c), nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "ok" {
+		t.Error("Expected the round tripper response, got", r)
+	}
+}
+
+func TestContextDeadlineCancelsUpstream(t *testing.T) {
+	canceled := make(chan bool, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+			canceled <- true
+		}
+	}))
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.WithTimeout(50 * time.Millisecond)
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	start := time.Now()
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout || time.Since(start) > time.Second {
+		t.Errorf("Expected the handler deadline to fail the request, got %s after %v", resp.Status, time.Since(start))
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("Expected the upstream request to be canceled")
+	}
+}
+
+func TestContextClientGone(t *testing.T) {
+	arrived, canceled := make(chan bool), make(chan bool, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+			canceled <- true
+		}
+	}))
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	go func() {
+		<-arrived
+		cancel()
+	}()
+	if _, err := client.Do(req.WithContext(c)); err == nil {
+		t.Fatal("Expected the client request to be canceled")
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("Expected the upstream request to end with the client connection")
+	}
+}
+
+func TestContextMitmInheritsConnect(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *myproxy.ProxyCtx) (*myproxy.ConnectAction, string) {
+		ctx.WithValue(ctxKey("tenant"), "acme")
+		return myproxy.MitmConnect, host
+	})
+	var got interface{}
+	var done bool
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		got = ctx.Context().Value(ctxKey("tenant"))
+		done = ctx.ConnectCtx.Context().Err() != nil
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(https.URL+"/bobo", client, t)
+	if got != "acme" {
+		t.Error("Expected MITM request to see the CONNECT context value, got", got)
+	}
+	if done {
+		t.Error("Expected the CONNECT context to live as long as its tunnel")
+	}
+}
+
+func TestContextDeadlineCancelsUpstreamDial(t *testing.T) {
+	// an upstream proxy that accepts connections and never answers
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	defer hung.Close()
+	go func() {
+		for {
+			c, err := hung.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	for _, scheme := range []string{"http", "socks5h"} {
+		proxy := myproxy.NewProxyHttpServer()
+		proxy.OnRequest().HandleConnectFunc(func(host string, ctx *myproxy.ProxyCtx) (*myproxy.ConnectAction, string) {
+			ctx.WithTimeout(50 * time.Millisecond)
+			return myproxy.OkConnect, host
+		})
+		panicOnErr(proxy.OnRequest().RouteToURL(scheme+"://"+hung.Addr().String()), "RouteToURL")
+		s := httptest.NewServer(proxy)
+
+		c, err := net.Dial("tcp", s.Listener.Addr().String())
+		panicOnErr(err, "dial proxy")
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		start := time.Now()
+		io.WriteString(c, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Errorf("Expected the %s dial to give up with the exchange, got %v", scheme, err)
+		} else if resp.StatusCode == http.StatusOK || time.Since(start) > time.Second {
+			t.Errorf("Expected the %s dial to fail with the exchange, got %s after %v", scheme, resp.Status, time.Since(start))
+		}
+		c.Close()
+		s.Close()
+	}
+}
@@ -1,8 +1,12 @@
 package myproxy
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 type ProxyCtx struct {
@@ -14,6 +18,61 @@ type ProxyCtx struct {
 	RoundTripper RoundTripper
 	certStore    CertStorage
 	UserData     interface{}
+	ConnectCtx   *ProxyCtx
+	RequestID    string
+
+	ctx           context.Context
+	cancel        context.CancelFunc
+	connectAction ConnectActionLiteral
+	connectSet    bool
+	start         time.Time
+	user          string
+	upstream      string
+	status        int
+	completed     int32
+	bytesIn       int64
+	bytesOut      int64
+	lastActivity  int64
+	timers        timers
+	table         *handlerTable
+	respHooks     []RespHandler
+	completeHooks []func(ctx *ProxyCtx)
+	trace         *trace
+	timings       timings
+
+	upstreamTimeout    time.Duration
+	upstreamTimeoutSet bool
+}
+
+func (proxy *ProxyHttpServer) newCtx(req *http.Request, connect *ProxyCtx) *ProxyCtx {
+	ctx := &ProxyCtx{
+		Req:       req,
+		Session:   atomic.AddInt64(&proxy.sess, 1),
+		Proxy:     proxy,
+		RequestID: requestID(req),
+		table:     proxy.handlers(),
+		start:     time.Now(),
+		user:      proxyUser(req),
+	}
+	ctx.lastActivity = ctx.start.UnixNano()
+	ctx.initContext(req, connect)
+	if connect != nil {
+		ctx.UserData, ctx.RoundTripper, ctx.ConnectCtx = connect.UserData, connect.RoundTripper, connect
+		ctx.upstream = connect.upstream
+		if ctx.user == "" {
+			ctx.user = connect.user
+		}
+	}
+	ctx.trace = proxy.startTrace(req, connect)
+	if req != nil && req.Body != nil && req.Body != http.NoBody {
+		body := &countingBody{ReadCloser: req.Body, n: &ctx.bytesIn}
+		// the bytes of MITM'd requests are counted by their tunnel
+		if connect == nil {
+			body.m = proxy.Metrics
+		}
+		req.Body = body
+	}
+	return ctx
 }
 
 type RoundTripper interface {
@@ -24,20 +83,100 @@ type CertStorage interface {
 	Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error)
 }
 
-func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
+func (ctx *ProxyCtx) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	req = req.WithContext(ctx.timings.context(mergeContexts(req.Context(), ctx.Context())))
+	defer func() { timeBody(resp, &ctx.timings) }()
+	req, finish := ctx.withUpstreamTimeout(req)
+	defer func() { finish(resp, err) }()
+	if span := ctx.trace.start("upstream "+req.Method, SpanKindClient, nil); span != nil {
+		span.set("http.url", req.URL.String())
+		defer func() {
+			if resp != nil {
+				span.set("http.status_code", resp.StatusCode)
+			}
+			ctx.trace.end(span, err)
+		}()
+		req.Header.Set("traceparent", ctx.trace.traceparent(span))
+		req = req.WithContext(ctx.trace.context(req.Context(), span))
+	}
+	if ctx.RoundTripper != nil {
+		defer ctx.Proxy.Metrics.observeUpstream("request", "custom", time.Now())
+		return ctx.RoundTripper.RoundTrip(req, ctx)
+	}
+	u := ctx.Proxy.upstreamFor(req, ctx)
+	defer ctx.Proxy.Metrics.observeUpstream("request", upstreamName(u), time.Now())
+	ctx.upstream = req.URL.Host
+	if u != nil {
+		ctx.upstream = u.String()
+		ctx.Logf("Routing request to upstream %v", u)
+		return ctx.Proxy.upstreamTransport(u).RoundTrip(req)
+	}
 	return ctx.Proxy.Tr.RoundTrip(req)
 }
 
-func (ctx *ProxyCtx) printf(msg string, argv ...interface{}) {
-	ctx.Proxy.Logger.Printf("[%03d]"+msg+"\n", append([]interface{}{ctx.Session & 0xFF}, argv...)...)
+type RoundTripperFunc func(req *http.Request, ctx *ProxyCtx) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+	return f(req, ctx)
 }
 
-func (ctx *ProxyCtx) Logf(msg string, argv ...interface{}) {
-	if ctx.Proxy.Verbose {
-		ctx.printf("INFO: "+msg, argv...)
+// User is the proxy user of the request, from the Basic credentials of its
+// Proxy-Authorization header or the CONNECT it came through, unless a
+// handler called SetUser.
+func (ctx *ProxyCtx) User() string {
+	return ctx.user
+}
+
+// SetUser records the user a handler authenticated the request as, for the
+// conditions and the access log.
+func (ctx *ProxyCtx) SetUser(user string) {
+	ctx.user = user
+}
+
+// fields are the structured fields of every line logged for ctx.
+func (ctx *ProxyCtx) fields() []interface{} {
+	fields := []interface{}{"session", ctx.Session}
+	req, connect := ctx.Req, ctx
+	if ctx.ConnectCtx != nil {
+		connect = ctx.ConnectCtx
+		if req == nil {
+			req = connect.Req
+		}
+	}
+	if req != nil {
+		host := req.Host
+		if req.URL != nil && req.URL.Host != "" {
+			host = req.URL.Host
+		}
+		fields = append(fields, "client", req.RemoteAddr, "host", host)
+	}
+	if connect.connectSet {
+		fields = append(fields, "action", connect.connectAction.String())
+	}
+	if ctx.RequestID != "" {
+		fields = append(fields, "request_id", ctx.RequestID)
+	}
+	return fields
+}
+
+func (ctx *ProxyCtx) logf(level LogLevel, msg string, argv ...interface{}) {
+	if ctx.Proxy.logEnabled(level) {
+		ctx.Proxy.log(level, fmt.Sprintf(msg, argv...), ctx.fields()...)
 	}
 }
 
+func (ctx *ProxyCtx) Debugf(msg string, argv ...interface{}) {
+	ctx.logf(LevelDebug, msg, argv...)
+}
+
+func (ctx *ProxyCtx) Logf(msg string, argv ...interface{}) {
+	ctx.logf(LevelInfo, msg, argv...)
+}
+
 func (ctx *ProxyCtx) Warnf(msg string, argv ...interface{}) {
-	ctx.printf("WARN: "+msg, argv...)
+	ctx.logf(LevelWarn, msg, argv...)
+}
+
+func (ctx *ProxyCtx) Errorf(msg string, argv ...interface{}) {
+	ctx.logf(LevelError, msg, argv...)
 }
@@ -20,18 +20,20 @@ type ProxyConds struct {
 	proxy     *ProxyHttpServer
 	reqConds  []ReqCondition
 	respConds []RespCondition
+	handlerOptions
 }
 
 func (proxy *ProxyHttpServer) OnRequest(conds ...ReqCondition) *ReqProxyConds {
-	return &ReqProxyConds{proxy, conds}
+	return &ReqProxyConds{proxy: proxy, reqConds: conds}
 }
 func (proxy *ProxyHttpServer) OnResponse(conds ...RespCondition) *ProxyConds {
-	return &ProxyConds{proxy, make([]ReqCondition, 0), conds}
+	return &ProxyConds{proxy: proxy, reqConds: make([]ReqCondition, 0), respConds: conds}
 }
 
 type ReqProxyConds struct {
 	proxy    *ProxyHttpServer
 	reqConds []ReqCondition
+	handlerOptions
 }
 
 type ReqConditionFunc func(req *http.Request, ctx *ProxyCtx) bool
@@ -51,8 +53,13 @@ func (c RespConditionFunc) HandleResp(resp *http.Response, ctx *ProxyCtx) bool {
 
 func SrcIpIs(ips ...string) ReqCondition {
 	return ReqConditionFunc(func(req *http.Request, ctx *ProxyCtx) bool {
+		src := srcIP(req)
 		for _, ip := range ips {
-			if strings.HasPrefix(req.RemoteAddr, ip+":") {
+			if parsed := net.ParseIP(ip); parsed != nil && src != nil {
+				if parsed.Equal(src) {
+					return true
+				}
+			} else if strings.HasPrefix(req.RemoteAddr, ip+":") {
 				return true
 			}
 		}
@@ -88,10 +95,9 @@ func ContentTypeIs(typ string, types ...string) RespCondition {
 	})
 }
 
+// DstHostIs matches requests to host, see HostIs.
 func DstHostIs(host string) ReqConditionFunc {
-	return func(req *http.Request, ctx *ProxyCtx) bool {
-		return req.URL.Host == host
-	}
+	return HostIs(host)
 }
 
 func UrlMatches(re *regexp.Regexp) ReqConditionFunc {
@@ -100,34 +106,28 @@ func UrlMatches(re *regexp.Regexp) ReqConditionFunc {
 	}
 }
 
+// ReqHostIs matches requests to any of hosts, see HostIs.
 func ReqHostIs(hosts ...string) ReqConditionFunc {
-	hostSet := make(map[string]bool)
-	for _, h := range hosts {
-		hostSet[h] = true
-	}
-	return func(req *http.Request, ctx *ProxyCtx) bool {
-		_, ok := hostSet[req.URL.Host]
-		return ok
-	}
+	return HostIs(hosts...)
 }
 
-func (pcond *ReqProxyConds) Do(h ReqHandler) {
-	pcond.proxy.reqHandlers = append(pcond.proxy.reqHandlers, FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+func (pcond *ReqProxyConds) Do(h ReqHandler) *Registration {
+	return pcond.proxy.addHandler(pcond.handlerOptions, &handlerEntry{req: FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
 		for _, cond := range pcond.reqConds {
 			if !cond.HandleReq(r, ctx) {
 				return r, nil
 			}
 		}
 		return h.Handle(r, ctx)
-	}))
+	})})
 }
 
-func (pcond *ReqProxyConds) DoFunc(f func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response)) {
-	pcond.Do(FuncReqHandler(f))
+func (pcond *ReqProxyConds) DoFunc(f func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response)) *Registration {
+	return pcond.Do(FuncReqHandler(f))
 }
 
-func (pcond *ProxyConds) Do(h RespHandler) {
-	pcond.proxy.respHandlers = append(pcond.proxy.respHandlers, FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+func (pcond *ProxyConds) Do(h RespHandler) *Registration {
+	return pcond.proxy.addHandler(pcond.handlerOptions, &handlerEntry{resp: FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
 		for _, cond := range pcond.reqConds {
 			if !cond.HandleReq(ctx.Req, ctx) {
 				return resp
@@ -139,48 +139,65 @@ func (pcond *ProxyConds) Do(h RespHandler) {
 			}
 		}
 		return h.Handle(resp, ctx)
-	}))
+	})})
 }
 
-func (pcond *ProxyConds) DoFunc(f func(resp *http.Response, ctx *ProxyCtx) *http.Response) {
-	pcond.Do(FuncRespHandler(f))
+func (pcond *ProxyConds) DoFunc(f func(resp *http.Response, ctx *ProxyCtx) *http.Response) *Registration {
+	return pcond.Do(FuncRespHandler(f))
 }
 
-func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) {
-	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers, FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) *Registration {
+	return pcond.proxy.addHandler(pcond.handlerOptions, &handlerEntry{https: FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 		for _, cond := range pcond.reqConds {
 			if !cond.HandleReq(ctx.Req, ctx) {
 				return nil, ""
 			}
 		}
 		return h.HandleConnect(host, ctx)
-	}))
+	})})
 }
 
-func (pcond *ReqProxyConds) HandleConnectFunc(f func(host string, ctx *ProxyCtx) (*ConnectAction, string)) {
-	pcond.HandleConnect(FuncHttpsHandler(f))
+func (pcond *ReqProxyConds) HandleConnectFunc(f func(host string, ctx *ProxyCtx) (*ConnectAction, string)) *Registration {
+	return pcond.HandleConnect(FuncHttpsHandler(f))
 }
 
-func (pcond *ReqProxyConds) HijackConnect(f func(req *http.Request, client net.Conn, ctx *ProxyCtx)) {
-	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers,
-		FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
-			for _, cond := range pcond.reqConds {
-				if !cond.HandleReq(ctx.Req, ctx) {
-					return nil, ""
-				}
+func (pcond *ReqProxyConds) DoTunnel(h TunnelHandler) *Registration {
+	return pcond.proxy.addHandler(pcond.handlerOptions, &handlerEntry{tunnel: FuncTunnelHandler(func(client net.Conn, ctx *ProxyCtx) net.Conn {
+		for _, cond := range pcond.reqConds {
+			if !cond.HandleReq(ctx.Req, ctx) {
+				return client
 			}
-			return &ConnectAction{Action: ConnectHijack, Hijack: f}, host
-		}))
+		}
+		return h.HandleTunnel(client, ctx)
+	})})
+}
+
+func (pcond *ReqProxyConds) DoTunnelFunc(f func(client net.Conn, ctx *ProxyCtx) net.Conn) *Registration {
+	return pcond.DoTunnel(FuncTunnelHandler(f))
+}
+
+func (pcond *ReqProxyConds) HijackConnect(f func(req *http.Request, client net.Conn, ctx *ProxyCtx)) *Registration {
+	return pcond.proxy.addHandler(pcond.handlerOptions, &handlerEntry{https: FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		for _, cond := range pcond.reqConds {
+			if !cond.HandleReq(ctx.Req, ctx) {
+				return nil, ""
+			}
+		}
+		return &ConnectAction{Action: ConnectHijack, Hijack: f}, host
+	})})
 }
 
 var AlwaysMitm FuncHttpsHandler = func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 	return MitmConnect, host
 }
 
+// ReqHostMatches matches requests whose host, normalized as by HostIs,
+// matches any of regexps either alone or followed by its port, as in
+// "example.com:443".
 func ReqHostMatches(regexps ...*regexp.Regexp) ReqConditionFunc {
 	return func(req *http.Request, ctx *ProxyCtx) bool {
 		for _, re := range regexps {
-			if re.MatchString(req.Host) {
+			if reqHostMatches(req, re) {
 				return true
 			}
 		}
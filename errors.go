@@ -0,0 +1,205 @@
+package myproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// ErrorClass tells why the proxy could not answer a request.
+type ErrorClass string
+
+const (
+	ErrorDNS               ErrorClass = "dns"
+	ErrorConnectionRefused ErrorClass = "connection_refused"
+	ErrorTimeout           ErrorClass = "timeout"
+	ErrorTLS               ErrorClass = "tls_verification"
+	ErrorUpstreamProxy     ErrorClass = "upstream_proxy_refused"
+	ErrorBlocked           ErrorClass = "blocked"
+	ErrorHandlerPanic      ErrorClass = "handler_panic"
+	ErrorUpstream          ErrorClass = "upstream"
+	ErrorInternal          ErrorClass = "internal"
+)
+
+// ErrBlocked is the error of requests a handler refused to serve, see
+// ErrorResponse.
+var ErrBlocked = errors.New("blocked by proxy rule")
+
+var errNoResponse = errors.New("no response")
+
+var errorClasses = map[ErrorClass]struct {
+	status  int
+	message string
+}{
+	ErrorDNS:               {http.StatusBadGateway, "The host name could not be resolved."},
+	ErrorConnectionRefused: {http.StatusServiceUnavailable, "The server refused the connection."},
+	ErrorTimeout:           {http.StatusGatewayTimeout, "The server did not answer in time."},
+	ErrorTLS:               {http.StatusBadGateway, "The certificate of the server could not be verified."},
+	ErrorUpstreamProxy:     {http.StatusBadGateway, "The upstream proxy refused the connection."},
+	ErrorBlocked:           {http.StatusForbidden, "Access to this site is blocked by the proxy."},
+	ErrorHandlerPanic:      {http.StatusInternalServerError, "A rule of the proxy failed on this request."},
+	ErrorUpstream:          {http.StatusBadGateway, "The connection to the server failed."},
+	ErrorInternal:          {http.StatusInternalServerError, "The proxy could not handle the request."},
+}
+
+// ClassifyError tells the class of an error met while proxying a request.
+func ClassifyError(err error) ErrorClass {
+	var dnsErr *net.DNSError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var handlerPanic *HandlerPanic
+	switch {
+	case err == nil || err == errNoResponse:
+		return ErrorInternal
+	case errors.As(err, &handlerPanic):
+		return ErrorHandlerPanic
+	case errors.Is(err, ErrBlocked):
+		return ErrorBlocked
+	case errors.Is(err, errProxyRefused):
+		return ErrorUpstreamProxy
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		return ErrorTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorConnectionRefused
+	case errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid):
+		return ErrorTLS
+	}
+	return ErrorUpstream
+}
+
+// Status is the HTTP status of the responses to errors of class c.
+func (c ErrorClass) Status() int {
+	if e, ok := errorClasses[c]; ok {
+		return e.status
+	}
+	return http.StatusBadGateway
+}
+
+// ErrorPage is what the error templates of the proxy are executed with.
+type ErrorPage struct {
+	Status     int        `json:"status"`
+	StatusText string     `json:"status_text"`
+	Class      ErrorClass `json:"error"`
+	Message    string     `json:"message"`
+	URL        string     `json:"url,omitempty"`
+	RequestID  string     `json:"request_id"`
+}
+
+var DefaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .URL}}<p>URL: {{.URL}}</p>
+{{end}}<p>Request ID: <code>{{.RequestID}}</code></p>
+</body>
+</html>
+`))
+
+func newErrorPage(ctx *ProxyCtx, err error) *ErrorPage {
+	class := ClassifyError(err)
+	status := class.Status()
+	page := &ErrorPage{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Class:      class,
+		Message:    errorClasses[class].message,
+		RequestID:  ctx.RequestID,
+	}
+	if ctx.Req != nil && ctx.Req.URL != nil {
+		page.URL = ctx.Req.URL.String()
+		if ctx.Req.Method == "CONNECT" {
+			page.URL = ctx.Req.URL.Host
+		}
+	}
+	return page
+}
+
+func wantsJSON(req *http.Request) bool {
+	return req != nil && strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+func (proxy *ProxyHttpServer) renderError(ctx *ProxyCtx, page *ErrorPage, asJSON bool) (string, []byte) {
+	var buf bytes.Buffer
+	var err error
+	contentType := ContentTypeHtml + "; charset=utf-8"
+	switch {
+	case asJSON && proxy.ErrorJSONTemplate != nil:
+		contentType = "application/json"
+		err = proxy.ErrorJSONTemplate.Execute(&buf, page)
+	case asJSON:
+		contentType = "application/json"
+		err = json.NewEncoder(&buf).Encode(page)
+	case proxy.ErrorTemplate != nil:
+		err = proxy.ErrorTemplate.Execute(&buf, page)
+	default:
+		err = DefaultErrorTemplate.Execute(&buf, page)
+	}
+	if err != nil {
+		ctx.Warnf("Cannot render error page: %v", err)
+		return ContentTypeText, []byte(page.Message + "\n")
+	}
+	return contentType, buf.Bytes()
+}
+
+// ErrorResponse is the error page of the proxy for err, handlers can return
+// it, for instance with ErrBlocked.
+func ErrorResponse(ctx *ProxyCtx, err error) *http.Response {
+	page := newErrorPage(ctx, err)
+	contentType, body := ctx.Proxy.renderError(ctx, page, wantsJSON(ctx.Req))
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", page.Status, http.StatusText(page.Status)),
+		StatusCode:    page.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       ctx.Req,
+	}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("X-Request-Id", ctx.RequestID)
+	resp.Header.Set("X-Proxy-Error", string(page.Class))
+	return resp
+}
+
+// writeError answers a request the proxy could not serve with the error page
+// for err, and returns its status.
+func (proxy *ProxyHttpServer) writeError(w http.ResponseWriter, ctx *ProxyCtx, err error) int {
+	ctx.Warnf("Cannot serve %v: %v", ctx.Req.URL, err)
+	resp := ErrorResponse(ctx, err)
+	copyHeaders(w.Header(), resp.Header, false)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return resp.StatusCode
+}
+
+// httpError answers the client of a raw connection with the error page for
+// err and closes it. It returns the status of the page.
+func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) int {
+	resp := ErrorResponse(ctx, err)
+	resp.Close = true
+	ctx.status = resp.StatusCode
+	if err := resp.Write(w); err != nil {
+		ctx.Warnf("Error responding to client: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		ctx.Warnf("Error closing client connection: %s", err)
+	}
+	return resp.StatusCode
+}
@@ -0,0 +1,147 @@
+package myproxy_test
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/fj9140/myproxy"
+)
+
+func TestClassifyError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	for _, tc := range []struct {
+		err    error
+		class  myproxy.ErrorClass
+		status int
+	}{
+		{&net.DNSError{Err: "no such host", Name: "nowhere.invalid"}, myproxy.ErrorDNS, 502},
+		{refused, myproxy.ErrorConnectionRefused, 503},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), myproxy.ErrorTimeout, 504},
+		{x509.UnknownAuthorityError{}, myproxy.ErrorTLS, 502},
+		{fmt.Errorf("rule 3: %w", myproxy.ErrBlocked), myproxy.ErrorBlocked, 403},
+		{errors.New("connection reset"), myproxy.ErrorUpstream, 502},
+		{nil, myproxy.ErrorInternal, 500},
+	} {
+		class := myproxy.ClassifyError(tc.err)
+		if class != tc.class || class.Status() != tc.status {
+			t.Errorf("Expected %v to be %s (%d), got %s (%d)", tc.err, tc.class, tc.status, class, class.Status())
+		}
+	}
+}
+
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+func TestErrorPageHTML(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get("http://" + closedAddr(t) + "/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	id := resp.Header.Get("X-Request-Id")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("X-Proxy-Error") != "connection_refused" {
+		t.Errorf("Expected a refused connection error, got %s %v", resp.Status, resp.Header)
+	}
+	if id == "" || !strings.Contains(string(b), id) || !strings.Contains(string(b), "refused the connection") {
+		t.Errorf("Expected the request ID %q and the cause in the page, got %s", id, b)
+	}
+}
+
+func TestErrorPageJSON(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	req, _ := http.NewRequest("GET", "http://"+closedAddr(t)+"/bobo", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Request-Id", "req-42")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var page myproxy.ErrorPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Status != 503 || page.Class != myproxy.ErrorConnectionRefused || page.RequestID != "req-42" {
+		t.Errorf("Unexpected error page %+v", page)
+	}
+}
+
+func TestErrorPageConnect(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, resp := connectThrough(t, l, closedAddr(t))
+	defer c.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(b), resp.Header.Get("X-Request-Id")) {
+		t.Errorf("Expected an error page for the CONNECT, got %s %s", resp.Status, b)
+	}
+}
+
+func TestErrorPageRejectedConnect(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysReject)
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, resp := connectThrough(t, l, https.Listener.Addr().String())
+	defer c.Close()
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("X-Proxy-Error") != "blocked" {
+		t.Errorf("Expected rejected CONNECT to be blocked, got %s %v", resp.Status, resp.Header)
+	}
+}
+
+func TestErrorPageMitmBlocked(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.ErrorTemplate = template.Must(template.New("error").Parse("{{.Class}} {{.Status}} {{.URL}}"))
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, myproxy.ErrorResponse(ctx, myproxy.ErrBlocked)
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(https.URL + "/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if expected := "blocked 403 " + https.URL + "/bobo"; resp.StatusCode != 403 || string(b) != expected {
+		t.Errorf("Expected %q from the custom template, got %s %q", expected, resp.Status, b)
+	}
+}
+
+func TestErrorResponseStatus(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp := myproxy.ErrorResponse(&myproxy.ProxyCtx{Req: req, Proxy: myproxy.NewProxyHttpServer()}, myproxy.ErrBlocked)
+	if resp.Status != "403 Forbidden" {
+		t.Errorf("Expected the status line of a response, got %q", resp.Status)
+	}
+}
@@ -0,0 +1,607 @@
+package myproxy
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ParseCondition parses a condition written as an expression, to be used in
+// rules kept as text:
+//
+//	host ~ "*.example.com" && method == "POST" && !src in 10.0.0.0/8
+//
+// An expression compares attributes of the exchange with values, and
+// combines comparisons with &&, || and !, and parentheses. The attributes
+// are:
+//
+//	host, method, scheme, port, path, url         of the request
+//	user_agent, header["Name"], query["name"]     of the request
+//	cookie["name"]                                of the request
+//	src, user                                     the client IP and proxy user
+//	status, content_type, resp_header["Name"]     of the response
+//
+// Response attributes are empty when the condition is checked on a request.
+// Comparisons are == and !=, ~ for a glob where * matches any run of
+// characters, =~ for a regular expression, in for a list of values such as
+// ["GET", "HEAD"], and <, <=, > and >= for numbers. src compares IP addresses,
+// and is in CIDR ranges or lists of ranges. An attribute alone is true when
+// it is not empty, for instance header["Authorization"]. host compares with
+// the patterns of HostIs without port, and method case-insensitively. Values
+// are quoted strings, numbers, or bare words.
+func ParseCondition(expr string) (ReqCondition, error) {
+	toks, err := lexExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{expr: expr, toks: toks}
+	eval, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+	return &exprCond{src: expr, eval: eval}, nil
+}
+
+// MustParseCondition is ParseCondition for expressions known to be valid, it
+// panics on errors.
+func MustParseCondition(expr string) ReqCondition {
+	c, err := ParseCondition(expr)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+type condEnv struct {
+	req  *http.Request
+	resp *http.Response
+	ctx  *ProxyCtx
+}
+
+type exprCond struct {
+	src  string
+	eval func(env *condEnv) bool
+}
+
+func (c *exprCond) HandleReq(req *http.Request, ctx *ProxyCtx) bool {
+	return c.eval(&condEnv{req: req, ctx: ctx})
+}
+
+func (c *exprCond) HandleResp(resp *http.Response, ctx *ProxyCtx) bool {
+	return c.eval(&condEnv{req: ctx.Req, resp: resp, ctx: ctx})
+}
+
+func (c *exprCond) String() string {
+	return c.src
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokWord
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+var compareOps = map[string]bool{"==": true, "!=": true, "~": true, "=~": true, "<": true, "<=": true, ">": true, ">=": true}
+
+var exprOps = []string{"&&", "||", "==", "!=", "=~", "<=", ">=", "!", "~", "<", ">", "(", ")", "[", "]", ","}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("_.:/*-", c) >= 0
+}
+
+func lexExpr(expr string) ([]token, error) {
+	var toks []token
+	i := 0
+next:
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '"':
+			j := i + 1
+			for ; j < len(expr) && expr[j] != '"'; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("condition %q: unterminated string at %d", expr, i)
+			}
+			s, err := strconv.Unquote(expr[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("condition %q: bad string at %d: %v", expr, i, err)
+			}
+			toks = append(toks, token{tokString, s, i})
+			i = j + 1
+			continue
+		case isWordByte(c):
+			j := i
+			for j < len(expr) && isWordByte(expr[j]) {
+				j++
+			}
+			toks = append(toks, token{tokWord, expr[i:j], i})
+			i = j
+			continue
+		}
+		for _, op := range exprOps {
+			if strings.HasPrefix(expr[i:], op) {
+				toks = append(toks, token{tokOp, op, i})
+				i += len(op)
+				continue next
+			}
+		}
+		return nil, fmt.Errorf("condition %q: unexpected %q at %d", expr, c, i)
+	}
+	return append(toks, token{tokEOF, "", len(expr)}), nil
+}
+
+type exprParser struct {
+	expr string
+	toks []token
+	i    int
+}
+
+func (p *exprParser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *exprParser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *exprParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+func (p *exprParser) expect(op string) error {
+	if t := p.next(); t.kind != tokOp || t.text != op {
+		return p.errorf(t, "expected %q", op)
+	}
+	return nil
+}
+
+func (p *exprParser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("condition %q: %s at %d", p.expr, fmt.Sprintf(format, args...), t.pos)
+}
+
+type evalFunc func(env *condEnv) bool
+
+func (p *exprParser) parseOr() (evalFunc, error) {
+	l, err := p.parseAnd()
+	for err == nil && p.isOp("||") {
+		p.next()
+		var r evalFunc
+		if r, err = p.parseAnd(); err == nil {
+			l = orEval(l, r)
+		}
+	}
+	return l, err
+}
+
+func orEval(l, r evalFunc) evalFunc {
+	return func(env *condEnv) bool { return l(env) || r(env) }
+}
+
+func (p *exprParser) parseAnd() (evalFunc, error) {
+	l, err := p.parseUnary()
+	for err == nil && p.isOp("&&") {
+		p.next()
+		var r evalFunc
+		if r, err = p.parseUnary(); err == nil {
+			l = andEval(l, r)
+		}
+	}
+	return l, err
+}
+
+func andEval(l, r evalFunc) evalFunc {
+	return func(env *condEnv) bool { return l(env) && r(env) }
+}
+
+func (p *exprParser) parseUnary() (evalFunc, error) {
+	if p.isOp("!") {
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *condEnv) bool { return !e(env) }, nil
+	}
+	if p.isOp("(") {
+		p.next()
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	}
+	return p.parseComparison()
+}
+
+type attrKind int
+
+const (
+	attrString attrKind = iota
+	attrIP
+	attrNumber
+	attrHost
+)
+
+type exprAttr struct {
+	kind attrKind
+	fold bool
+	get  func(env *condEnv) string
+}
+
+type attrFactory func(arg string) *exprAttr
+
+var exprAttrs = map[string]attrFactory{}
+
+// registerAttr adds an attribute to the expressions of ParseCondition,
+// withArg for those taking a name in brackets, as header["Name"].
+func registerAttr(name string, withArg bool, f attrFactory) {
+	if withArg {
+		name += "[]"
+	}
+	exprAttrs[name] = f
+}
+
+func simpleAttr(kind attrKind, fold bool, get func(env *condEnv) string) attrFactory {
+	return func(string) *exprAttr { return &exprAttr{kind: kind, fold: fold, get: get} }
+}
+
+func reqAttr(f func(req *http.Request) string) func(env *condEnv) string {
+	return func(env *condEnv) string {
+		if env.req == nil {
+			return ""
+		}
+		return f(env.req)
+	}
+}
+
+func respAttr(f func(resp *http.Response) string) func(env *condEnv) string {
+	return func(env *condEnv) string {
+		if env.resp == nil {
+			return ""
+		}
+		return f(env.resp)
+	}
+}
+
+func srcIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+func init() {
+	registerAttr("host", false, simpleAttr(attrHost, false, reqAttr(func(req *http.Request) string {
+		name, _ := reqHost(req)
+		return name
+	})))
+	registerAttr("method", false, simpleAttr(attrString, true, reqAttr(func(req *http.Request) string {
+		return req.Method
+	})))
+	registerAttr("scheme", false, simpleAttr(attrString, true, reqAttr(func(req *http.Request) string {
+		return req.URL.Scheme
+	})))
+	registerAttr("path", false, simpleAttr(attrString, false, reqAttr(func(req *http.Request) string {
+		return req.URL.Path
+	})))
+	registerAttr("url", false, simpleAttr(attrString, false, reqAttr(func(req *http.Request) string {
+		return req.URL.String()
+	})))
+	registerAttr("user_agent", false, simpleAttr(attrString, false, reqAttr(func(req *http.Request) string {
+		return req.UserAgent()
+	})))
+	registerAttr("src", false, simpleAttr(attrIP, false, reqAttr(func(req *http.Request) string {
+		if ip := srcIP(req); ip != nil {
+			return ip.String()
+		}
+		return ""
+	})))
+	registerAttr("port", false, simpleAttr(attrNumber, false, reqAttr(func(req *http.Request) string {
+		_, port := reqHost(req)
+		return strconv.Itoa(port)
+	})))
+	registerAttr("user", false, simpleAttr(attrString, false, func(env *condEnv) string {
+		if env.ctx == nil {
+			return ""
+		}
+		return env.ctx.User()
+	}))
+	registerAttr("header", true, func(name string) *exprAttr {
+		return &exprAttr{get: reqAttr(func(req *http.Request) string { return req.Header.Get(name) })}
+	})
+	registerAttr("query", true, func(name string) *exprAttr {
+		return &exprAttr{get: reqAttr(func(req *http.Request) string { return req.URL.Query().Get(name) })}
+	})
+	registerAttr("cookie", true, func(name string) *exprAttr {
+		return &exprAttr{get: reqAttr(func(req *http.Request) string {
+			if c, err := req.Cookie(name); err == nil {
+				return c.Value
+			}
+			return ""
+		})}
+	})
+	registerAttr("status", false, simpleAttr(attrNumber, false, respAttr(func(resp *http.Response) string {
+		return strconv.Itoa(resp.StatusCode)
+	})))
+	registerAttr("content_type", false, simpleAttr(attrString, true, respAttr(func(resp *http.Response) string {
+		typ, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		return typ
+	})))
+	registerAttr("resp_header", true, func(name string) *exprAttr {
+		return &exprAttr{get: respAttr(func(resp *http.Response) string { return resp.Header.Get(name) })}
+	})
+}
+
+func (p *exprParser) parseAttr() (*exprAttr, error) {
+	t := p.next()
+	if t.kind != tokWord {
+		return nil, p.errorf(t, "expected an attribute")
+	}
+	if p.isOp("[") {
+		p.next()
+		arg := p.next()
+		if arg.kind != tokString && arg.kind != tokWord {
+			return nil, p.errorf(arg, "expected a name")
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		if f := exprAttrs[t.text+"[]"]; f != nil {
+			return f(arg.text), nil
+		}
+	} else if f := exprAttrs[t.text]; f != nil {
+		return f(""), nil
+	}
+	return nil, p.errorf(t, "unknown attribute %q", t.text)
+}
+
+func (p *exprParser) parseValue() (token, error) {
+	t := p.next()
+	if t.kind != tokString && t.kind != tokWord {
+		return t, p.errorf(t, "expected a value")
+	}
+	return t, nil
+}
+
+func (p *exprParser) parseList() ([]token, error) {
+	if !p.isOp("[") {
+		t, err := p.parseValue()
+		return []token{t}, err
+	}
+	p.next()
+	var values []token
+	for {
+		t, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, t)
+		if p.isOp("]") {
+			p.next()
+			return values, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseComparison() (evalFunc, error) {
+	attr, err := p.parseAttr()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	switch {
+	case op.kind == tokWord && op.text == "in":
+		p.next()
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return p.compileIn(attr, values)
+	case op.kind == tokOp && compareOps[op.text]:
+		p.next()
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return p.compileCompare(attr, op, value)
+	}
+	return func(env *condEnv) bool { return attr.get(env) != "" }, nil
+}
+
+func (p *exprParser) compileIn(attr *exprAttr, values []token) (evalFunc, error) {
+	switch attr.kind {
+	case attrIP:
+		texts := make([]string, len(values))
+		for i, v := range values {
+			texts[i] = v.text
+		}
+		nets, err := parseIPNets(texts)
+		if err != nil {
+			return nil, p.errorf(values[0], "%v", err)
+		}
+		return func(env *condEnv) bool {
+			return ipInNets(net.ParseIP(attr.get(env)), nets)
+		}, nil
+	case attrHost:
+		return p.compileHosts(attr, values)
+	case attrNumber:
+		for _, v := range values {
+			if _, err := strconv.ParseInt(v.text, 10, 64); err != nil {
+				return nil, p.errorf(v, "expected a number")
+			}
+		}
+	}
+	set := make(map[string]bool)
+	for _, v := range values {
+		set[attr.normalize(v.text)] = true
+	}
+	return func(env *condEnv) bool {
+		v := attr.get(env)
+		return v != "" && set[attr.normalize(v)]
+	}, nil
+}
+
+// compileHosts matches hosts with the patterns of HostIs, ports aside.
+func (p *exprParser) compileHosts(attr *exprAttr, values []token) (evalFunc, error) {
+	patterns := make([]hostPattern, len(values))
+	for i, v := range values {
+		patterns[i] = parseHostPattern(v.text)
+		if patterns[i].port != 0 {
+			return nil, p.errorf(v, "hosts have no port, compare port instead")
+		}
+	}
+	return func(env *condEnv) bool {
+		name := attr.get(env)
+		for _, pattern := range patterns {
+			if name != "" && pattern.match(name, 0) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func (a *exprAttr) normalize(s string) string {
+	if a.fold {
+		return strings.ToLower(s)
+	}
+	return s
+}
+
+func (p *exprParser) compileCompare(attr *exprAttr, op, value token) (evalFunc, error) {
+	switch op.text {
+	case "==", "!=":
+		eq, err := p.compileIn(attr, []token{value})
+		if err != nil || op.text == "==" {
+			return eq, err
+		}
+		return func(env *condEnv) bool { return !eq(env) }, nil
+	case "~":
+		if attr.kind == attrHost {
+			return p.compileHosts(attr, []token{value})
+		}
+		pattern := attr.normalize(value.text)
+		return func(env *condEnv) bool {
+			return globMatch(pattern, attr.normalize(attr.get(env)))
+		}, nil
+	case "=~":
+		re, err := regexp.Compile(value.text)
+		if err != nil {
+			return nil, p.errorf(value, "%v", err)
+		}
+		return func(env *condEnv) bool { return re.MatchString(attr.get(env)) }, nil
+	}
+	if attr.kind != attrNumber {
+		return nil, p.errorf(op, "%s compares numbers only", op.text)
+	}
+	n, err := strconv.ParseInt(value.text, 10, 64)
+	if err != nil {
+		return nil, p.errorf(value, "expected a number")
+	}
+	cmp := map[string]func(v int64) bool{
+		"<":  func(v int64) bool { return v < n },
+		"<=": func(v int64) bool { return v <= n },
+		">":  func(v int64) bool { return v > n },
+		">=": func(v int64) bool { return v >= n },
+	}[op.text]
+	return func(env *condEnv) bool {
+		v, err := strconv.ParseInt(attr.get(env), 10, 64)
+		return err == nil && cmp(v)
+	}, nil
+}
+
+// globMatch tells whether s matches pattern, where * matches any run of
+// characters and ? any single one.
+func globMatch(pattern, s string) bool {
+	px, sx := 0, 0
+	starP, starS := -1, 0
+	for sx < len(s) {
+		switch {
+		case px < len(pattern) && (pattern[px] == '?' || pattern[px] == s[sx]):
+			px++
+			sx++
+		case px < len(pattern) && pattern[px] == '*':
+			starP, starS = px, sx
+			px++
+		case starP >= 0:
+			starS++
+			px, sx = starP+1, starS
+		default:
+			return false
+		}
+	}
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+	return px == len(pattern)
+}
+
+// parseIPNets parses IP addresses and CIDR ranges, an address being the
+// range of itself only.
+func parseIPNets(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if _, n, err := net.ParseCIDR(v); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("bad IP address or range %q", v)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package myproxy_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/fj9140/myproxy"
+)
+
+func TestParseCondition(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://API.Example.com:8443/v1/items?debug=1", nil)
+	req.RemoteAddr = "10.1.2.3:5555"
+	req.Header.Set("Authorization", "Bearer x")
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.AddCookie(&http.Cookie{Name: "lang", Value: "fr"})
+	resp := &http.Response{StatusCode: 503, Header: http.Header{
+		"Content-Type": {"application/json; charset=utf-8"},
+		"Server":       {"nginx"},
+	}}
+	ctx := &myproxy.ProxyCtx{Req: req}
+	ctx.SetUser("alice")
+
+	for _, tc := range []struct {
+		expr   string
+		onReq  bool
+		onResp bool
+	}{
+		{`host ~ "*.example.com" && method == "POST" && !src in 10.0.0.0/8`, false, false},
+		{`host ~ "*.example.com" && method == "POST" && !src in 192.168.0.0/16`, true, true},
+		{`host == api.example.com && method == post`, true, true},
+		{`src in [192.168.0.0/16, 10.1.2.3]`, true, true},
+		{`src == 10.1.2.4 || src != 10.1.2.3`, false, false},
+		{`scheme == https && path =~ "^/v[0-9]+/"`, true, true},
+		{`url ~ "https://*/items?*"`, true, true},
+		{`header["Authorization"] && !header["Referer"]`, true, true},
+		{`query["debug"] == 1 && user_agent ~ "curl/*"`, true, true},
+		{`method in [GET, HEAD]`, false, false},
+		{`port == 8443 && cookie["lang"] == fr && !cookie["other"]`, true, true},
+		{`user in [alice, bob] && port > 1024`, true, true},
+		{`(method == GET || method == POST) && (path == "/x" || path ~ "/v1/*")`, true, true},
+		{`status >= 500 && status < 600`, false, true},
+		{`status in [502, 503, 504]`, false, true},
+		{`!status`, true, false},
+		{`content_type == "application/json" && resp_header["Server"] == nginx`, false, true},
+	} {
+		cond, err := myproxy.ParseCondition(tc.expr)
+		if err != nil {
+			t.Errorf("Cannot parse %s: %v", tc.expr, err)
+			continue
+		}
+		if m := cond.HandleReq(req, ctx); m != tc.onReq {
+			t.Errorf("Expected %s to be %v on the request, got %v", tc.expr, tc.onReq, m)
+		}
+		if m := cond.HandleResp(resp, ctx); m != tc.onResp {
+			t.Errorf("Expected %s to be %v on the response, got %v", tc.expr, tc.onResp, m)
+		}
+	}
+}
+
+func TestParseConditionErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`host ==`,
+		`nope == 1`,
+		`host == "unterminated`,
+		`(method == GET`,
+		`method == GET)`,
+		`method = GET`,
+		`src in 10.0.0.0/99`,
+		`path =~ "("`,
+		`host > 3`,
+		`status < many`,
+		`method in [GET,`,
+	} {
+		if _, err := myproxy.ParseCondition(expr); err == nil {
+			t.Errorf("Expected an error parsing %q", expr)
+		}
+	}
+}
+
+func TestConditionFromText(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest(myproxy.MustParseCondition(`path == "/blocked" || query["block"] == yes`)).DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, myproxy.ErrorResponse(ctx, myproxy.ErrBlocked)
+	})
+	proxy.OnResponse(myproxy.MustParseCondition(`status == 403`)).DoFunc(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Rule", "blocked")
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for path, status := range map[string]int{"/blocked": 403, "/bobo?block=yes": 403, "/bobo": 200} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status || (status == 403) != (resp.Header.Get("X-Rule") == "blocked") {
+			t.Errorf("Expected %d for %s, got %s %v", status, path, resp.Status, resp.Header)
+		}
+	}
+}
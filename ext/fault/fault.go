@@ -0,0 +1,159 @@
+package myproxy_fault
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/fj9140/myproxy"
+)
+
+var ErrReset = errors.New("fault: connection reset")
+
+var (
+	rndMu sync.Mutex
+	rnd   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func roll(probability float64) bool {
+	rndMu.Lock()
+	defer rndMu.Unlock()
+	return rnd.Float64() < probability
+}
+
+// Status answers matching requests with code instead of forwarding them.
+func Status(probability float64, code int) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if !roll(probability) {
+			return req, nil
+		}
+		ctx.Warnf("Injecting fault: status %d for %v", code, req.URL)
+		return req, NewResponse(req, ContentTypeText, code, http.StatusText(code)+"\n")
+	})
+}
+
+// DelayHeaders holds matching requests for d before forwarding them, so
+// that the response headers come d later.
+func DelayHeaders(probability float64, d time.Duration) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if roll(probability) {
+			ctx.Warnf("Injecting fault: delaying %v by %v", req.URL, d)
+			time.Sleep(d)
+		}
+		return req, nil
+	})
+}
+
+// Reset aborts the connection to the client after n bytes of matching
+// response bodies. Install it with OnResponse.
+func Reset(probability float64, n int64) RespHandler {
+	return bodyFault(probability, "reset", func(body io.ReadCloser) io.ReadCloser {
+		return &cutBody{ReadCloser: body, left: n, err: ErrReset}
+	})
+}
+
+// Truncate ends matching response bodies after n bytes. Install it with
+// OnResponse.
+func Truncate(probability float64, n int64) RespHandler {
+	return bodyFault(probability, "truncate", func(body io.ReadCloser) io.ReadCloser {
+		return &cutBody{ReadCloser: body, left: n, err: io.EOF}
+	})
+}
+
+// Corrupt flips the bits of every byte of matching response bodies with
+// probability rate. Install it with OnResponse.
+func Corrupt(probability float64, rate float64) RespHandler {
+	return bodyFault(probability, "corrupt", func(body io.ReadCloser) io.ReadCloser {
+		return &corruptBody{ReadCloser: body, rate: rate}
+	})
+}
+
+// bodyFault only swaps the body, the proxy drops the Content-Length of
+// responses whose body was replaced.
+func bodyFault(probability float64, name string, wrap func(io.ReadCloser) io.ReadCloser) RespHandler {
+	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp == nil || !roll(probability) {
+			return resp
+		}
+		ctx.Warnf("Injecting fault: %s response of %v", name, ctx.Req.URL)
+		resp.Body = wrap(resp.Body)
+		return resp
+	})
+}
+
+// FailDial rejects matching CONNECTs with a 502, as if the target could not
+// be dialed.
+func FailDial(probability float64) HttpsHandler {
+	return FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		if !roll(probability) {
+			return nil, ""
+		}
+		ctx.Warnf("Injecting fault: failing dial to %s", host)
+		resp := NewResponse(ctx.Req, ContentTypeText, http.StatusBadGateway, "")
+		resp.ProtoMajor, resp.ProtoMinor = 1, 1
+		ctx.Resp = resp
+		return RejectConnect, host
+	})
+}
+
+// CloseWebSocket closes matching WebSocket connections after d. Install it
+// with DoTunnel. ws:// connections are told by their upgrade request, wss://
+// ones come through CONNECT tunnels which are all closed alike: match their
+// host with the conditions, as in
+//
+//	proxy.OnRequest(ReqHostIs("chat.example.com:443")).DoTunnel(CloseWebSocket(0.1, time.Minute))
+func CloseWebSocket(probability float64, d time.Duration) TunnelHandler {
+	return FuncTunnelHandler(func(client net.Conn, ctx *ProxyCtx) net.Conn {
+		if (ctx.Req.Method != http.MethodConnect && !isWebSocket(ctx.Req)) || !roll(probability) {
+			return client
+		}
+		url := ctx.Req.URL
+		time.AfterFunc(d, func() {
+			ctx.Warnf("Injecting fault: closing websocket %v", url)
+			client.Close()
+		})
+		return client
+	})
+}
+
+func isWebSocket(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+type cutBody struct {
+	io.ReadCloser
+	left int64
+	err  error
+}
+
+func (b *cutBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
+
+type corruptBody struct {
+	io.ReadCloser
+	rate float64
+}
+
+func (b *corruptBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	for i := 0; i < n; i++ {
+		if roll(b.rate) {
+			p[i] = ^p[i]
+		}
+	}
+	return n, err
+}
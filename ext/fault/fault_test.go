@@ -0,0 +1,228 @@
+package myproxy_fault_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+	myproxy_fault "github.com/fj9140/myproxy/ext/fault"
+)
+
+const body = "0123456789abcdef"
+
+var target = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, body)
+}))
+
+func faultyProxy(setup func(proxy *myproxy.ProxyHttpServer)) (*httptest.Server, *http.Client) {
+	proxy := myproxy.NewProxyHttpServer()
+	setup(proxy)
+	s := httptest.NewServer(proxy)
+	u, _ := url.Parse(s.URL)
+	return s, &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+}
+
+func TestStatus(t *testing.T) {
+	s, client := faultyProxy(func(proxy *myproxy.ProxyHttpServer) {
+		proxy.OnRequest(myproxy.UrlMatches(regexp.MustCompile("/fail$"))).
+			Do(myproxy_fault.Status(1, http.StatusServiceUnavailable))
+		proxy.OnRequest().Do(myproxy_fault.Status(0, http.StatusInternalServerError))
+	})
+	defer s.Close()
+
+	for path, expected := range map[string]int{"/fail": 503, "/ok": 200} {
+		resp, err := client.Get(target.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, path, resp.StatusCode)
+		}
+	}
+}
+
+func TestDelayHeaders(t *testing.T) {
+	s, client := faultyProxy(func(proxy *myproxy.ProxyHttpServer) {
+		proxy.OnRequest().Do(myproxy_fault.DelayHeaders(1, 100*time.Millisecond))
+	})
+	defer s.Close()
+
+	start := time.Now()
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Error("Expected headers to be delayed, took", elapsed)
+	}
+}
+
+func TestTruncateAndReset(t *testing.T) {
+	s, client := faultyProxy(func(proxy *myproxy.ProxyHttpServer) {
+		proxy.OnResponse(myproxy.UrlMatches(regexp.MustCompile("/truncate$"))).
+			Do(myproxy_fault.Truncate(1, 4))
+		proxy.OnResponse(myproxy.UrlMatches(regexp.MustCompile("/reset$"))).
+			Do(myproxy_fault.Reset(1, 4))
+	})
+	defer s.Close()
+
+	resp, err := client.Get(target.URL + "/truncate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(b) != body[:4] {
+		t.Errorf("Expected body truncated to %q, got %q %v", body[:4], b, err)
+	}
+
+	resp, err = client.Get(target.URL + "/reset")
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Error("Expected the client to see the connection reset")
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	s, client := faultyProxy(func(proxy *myproxy.ProxyHttpServer) {
+		proxy.OnResponse().Do(myproxy_fault.Corrupt(1, 1))
+	})
+	defer s.Close()
+
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(b) != len(body) {
+		t.Fatal("Expected the body length to be kept, got", len(b))
+	}
+	for i := range b {
+		if b[i] == body[i] {
+			t.Fatalf("Expected every byte to be corrupted, got %q", b)
+		}
+	}
+}
+
+func TestFailDial(t *testing.T) {
+	s, _ := faultyProxy(func(proxy *myproxy.ProxyHttpServer) {
+		proxy.OnRequest().HandleConnect(myproxy_fault.FailDial(1))
+	})
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "CONNECT "+target.Listener.Addr().String()+" HTTP/1.1\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Error("Expected CONNECT to fail with 502, got", resp.StatusCode)
+	}
+}
+
+func TestCloseWebSocket(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		if _, err := http.ReadRequest(br); err != nil {
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(c, br)
+	}()
+	s, _ := faultyProxy(func(proxy *myproxy.ProxyHttpServer) {
+		proxy.OnRequest().DoTunnel(myproxy_fault.CloseWebSocket(1, 50*time.Millisecond))
+	})
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET http://"+l.Addr().String()+"/ws HTTP/1.1\r\nHost: "+l.Addr().String()+
+		"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("Expected websocket upgrade, got", resp.StatusCode)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Error("Expected the websocket to be closed by the fault, got", err)
+	}
+}
+
+func TestCloseWebSocketTunnel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	s, _ := faultyProxy(func(proxy *myproxy.ProxyHttpServer) {
+		proxy.OnRequest(myproxy.ReqHostIs(l.Addr().String())).DoTunnel(myproxy_fault.CloseWebSocket(1, 50*time.Millisecond))
+	})
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "CONNECT "+l.Addr().String()+" HTTP/1.1\r\nHost: "+l.Addr().String()+"\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected the tunnel to open, got", resp.StatusCode)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Error("Expected the tunnel to be closed by the fault, got", err)
+	}
+}
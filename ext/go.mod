@@ -6,3 +6,13 @@ require (
 	github.com/fj9140/myproxy v0.0.0-20221230113733-7bbec1c90945
 	github.com/fj9140/myproxy/regretable v0.0.0-20221231094736-95cf3d97a458
 )
+
+require (
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
+
+replace (
+	github.com/fj9140/myproxy => ../
+	github.com/fj9140/myproxy/regretable => ../regretable
+)
@@ -0,0 +1,465 @@
+package myproxy_limit
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/fj9140/myproxy"
+)
+
+// KeyFunc returns the key a request is accounted to, requests with an empty
+// key are not limited by the rule.
+type KeyFunc func(req *http.Request, ctx *ProxyCtx) string
+
+func ByClientIP(req *http.Request, ctx *ProxyCtx) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// ByUser keys requests by the user name of the Basic Proxy-Authorization
+// header. Requests read from a MITM'd tunnel use the one of the CONNECT.
+func ByUser(req *http.Request, ctx *ProxyCtx) string {
+	if ctx.ConnectCtx != nil {
+		req = ctx.ConnectCtx.Req
+	}
+	authz := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	user, _, _ := authz.BasicAuth()
+	return user
+}
+
+func ByHost(req *http.Request, ctx *ProxyCtx) string {
+	return strings.ToLower(req.URL.Hostname())
+}
+
+// Rule limits every key independently. Zero values are unlimited.
+// RequestsPerSecond applies to plain and MITM'd requests as well as to
+// CONNECTs, MaxConcurrent to requests in flight and MaxTunnels to open
+// CONNECT tunnels. BytesPerSecond is shared by both directions of the
+// tunnels and plain HTTP bodies of a key.
+//
+// Clients over a limit get a 429 Too Many Requests, unless Delay is set, in
+// which case they are held for up to Delay waiting for the limit to allow
+// them.
+type Rule struct {
+	Key               KeyFunc
+	RequestsPerSecond float64
+	Burst             int
+	MaxConcurrent     int
+	MaxTunnels        int
+	BytesPerSecond    int64
+	Delay             time.Duration
+}
+
+type Limiter struct {
+	rules []*rule
+
+	mu     sync.Mutex
+	grants map[*ProxyCtx]*grant
+}
+
+func New(rules ...Rule) *Limiter {
+	l := &Limiter{grants: make(map[*ProxyCtx]*grant)}
+	for _, r := range rules {
+		if r.Key == nil {
+			r.Key = ByClientIP
+		}
+		l.rules = append(l.rules, &rule{Rule: r, keys: make(map[string]*keyState)})
+	}
+	return l
+}
+
+// Install registers the limiter on proxy for the requests matching conds.
+// It must be installed before any other CONNECT handler, since the first
+// one taking an action wins.
+func (l *Limiter) Install(proxy *ProxyHttpServer, conds ...ReqCondition) {
+	proxy.OnRequest(conds...).HandleConnect(l.HttpsHandler())
+	proxy.OnRequest(conds...).DoTunnel(l.TunnelHandler())
+	proxy.OnRequest(conds...).Do(l.ReqHandler())
+	proxy.OnResponse().Do(l.RespHandler())
+}
+
+// HttpsHandler rejects CONNECTs over the limits and leaves the others to the
+// next handlers.
+func (l *Limiter) HttpsHandler() HttpsHandler {
+	return FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		g, retry, ok := l.acquire(ctx.Req, ctx, true)
+		if !ok {
+			ctx.Resp = tooManyRequests(ctx.Req, retry)
+			return RejectConnect, host
+		}
+		g.release()
+		return nil, ""
+	})
+}
+
+// TunnelHandler accounts the tunnel and its bytes for as long as it is open.
+func (l *Limiter) TunnelHandler() TunnelHandler {
+	return FuncTunnelHandler(func(client net.Conn, ctx *ProxyCtx) net.Conn {
+		g, ok := l.tunnelGrant(ctx.Req, ctx)
+		if !ok {
+			ctx.Warnf("Tunnel slot taken by a concurrent CONNECT, rejecting")
+			ctx.Resp = tooManyRequests(ctx.Req, time.Second)
+			return nil
+		}
+		if g.empty() {
+			return client
+		}
+		c := &limitedConn{Conn: client, g: g}
+		if _, ok := client.(halfClosable); ok {
+			return &limitedHalfConn{limitedConn: c}
+		}
+		return c
+	})
+}
+
+func (l *Limiter) ReqHandler() ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		g, retry, ok := l.acquire(req, ctx, false)
+		if !ok {
+			return req, tooManyRequests(req, retry)
+		}
+		if g.empty() {
+			return req, nil
+		}
+		// MITM'd requests are already throttled by their tunnel
+		if ctx.ConnectCtx != nil {
+			g.buckets = nil
+		} else if req.Body != nil && len(g.buckets) > 0 {
+			req.Body = &limitedBody{ReadCloser: req.Body, g: &grant{buckets: g.buckets}}
+		}
+		l.mu.Lock()
+		l.grants[ctx] = g
+		l.mu.Unlock()
+		// websockets and answered requests may never reach RespHandler
+		ctx.OnComplete(func(ctx *ProxyCtx) {
+			l.mu.Lock()
+			delete(l.grants, ctx)
+			l.mu.Unlock()
+			g.release()
+		})
+		return req, nil
+	})
+}
+
+// RespHandler releases what ReqHandler acquired once the response body was
+// read, or the exchange is over.
+func (l *Limiter) RespHandler() RespHandler {
+	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		l.mu.Lock()
+		g := l.grants[ctx]
+		delete(l.grants, ctx)
+		l.mu.Unlock()
+		if g == nil {
+			return resp
+		}
+		if resp == nil || resp.Body == nil {
+			g.release()
+			return resp
+		}
+		resp.Body = &limitedBody{ReadCloser: resp.Body, g: g}
+		return resp
+	})
+}
+
+func tooManyRequests(req *http.Request, retry time.Duration) *http.Response {
+	resp := NewResponse(req, ContentTypeText, http.StatusTooManyRequests, "Too many requests\n")
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	return resp
+}
+
+// acquire takes a request token and a slot of every rule. When one of them
+// is over its limit, it returns how long the client should wait.
+func (l *Limiter) acquire(req *http.Request, ctx *ProxyCtx, tunnel bool) (*grant, time.Duration, bool) {
+	g := &grant{}
+	for _, r := range l.rules {
+		key := r.Key(req, ctx)
+		if key == "" {
+			continue
+		}
+		st := r.state(key)
+		if st.requests != nil {
+			wait, ok := st.requests.reserve(1, r.Delay)
+			if !ok {
+				g.release()
+				return nil, wait, false
+			}
+			time.Sleep(wait)
+		}
+		sem := st.conns
+		if tunnel {
+			sem = st.tunnels
+		}
+		if sem != nil {
+			if !acquireSlot(sem, r.Delay) {
+				g.release()
+				return nil, time.Second, false
+			}
+			g.sems = append(g.sems, sem)
+		}
+		if st.bytes != nil {
+			g.buckets = append(g.buckets, st.bytes)
+		}
+	}
+	return g, 0, true
+}
+
+// tunnelGrant takes the tunnel slots HttpsHandler checked are available,
+// waiting up to the rule's Delay for them when other tunnels raced for them.
+func (l *Limiter) tunnelGrant(req *http.Request, ctx *ProxyCtx) (*grant, bool) {
+	g := &grant{}
+	for _, r := range l.rules {
+		key := r.Key(req, ctx)
+		if key == "" {
+			continue
+		}
+		st := r.state(key)
+		if st.tunnels != nil {
+			if !acquireSlot(st.tunnels, r.Delay) {
+				g.release()
+				return nil, false
+			}
+			g.sems = append(g.sems, st.tunnels)
+		}
+		if st.bytes != nil {
+			g.buckets = append(g.buckets, st.bytes)
+		}
+	}
+	return g, true
+}
+
+func acquireSlot(sem chan struct{}, delay time.Duration) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+	if delay <= 0 {
+		return false
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+const pruneInterval = time.Minute
+
+type rule struct {
+	Rule
+	mu        sync.Mutex
+	keys      map[string]*keyState
+	lastPrune time.Time
+}
+
+type keyState struct {
+	requests *bucket
+	bytes    *bucket
+	conns    chan struct{}
+	tunnels  chan struct{}
+	lastUsed time.Time
+}
+
+func (r *rule) state(key string) *keyState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if now.Sub(r.lastPrune) > pruneInterval {
+		for k, st := range r.keys {
+			if now.Sub(st.lastUsed) > pruneInterval && len(st.conns) == 0 && len(st.tunnels) == 0 {
+				delete(r.keys, k)
+			}
+		}
+		r.lastPrune = now
+	}
+	st := r.keys[key]
+	if st == nil {
+		st = &keyState{}
+		if r.RequestsPerSecond > 0 {
+			burst := float64(r.Burst)
+			if burst < 1 {
+				burst = 1
+			}
+			st.requests = newBucket(r.RequestsPerSecond, burst)
+		}
+		if r.BytesPerSecond > 0 {
+			st.bytes = newBucket(float64(r.BytesPerSecond), float64(r.BytesPerSecond))
+		}
+		if r.MaxConcurrent > 0 {
+			st.conns = make(chan struct{}, r.MaxConcurrent)
+		}
+		if r.MaxTunnels > 0 {
+			st.tunnels = make(chan struct{}, r.MaxTunnels)
+		}
+		r.keys[key] = st
+	}
+	st.lastUsed = now
+	return st
+}
+
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate, burst float64) *bucket {
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n tokens, possibly going into debt if it can be paid back
+// within max. It returns how long the caller must wait before going on.
+func (b *bucket) reserve(n float64, max time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0, true
+	}
+	wait := time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	if wait > max {
+		return wait, false
+	}
+	b.tokens -= n
+	return wait, true
+}
+
+type grant struct {
+	sems    []chan struct{}
+	buckets []*bucket
+	once    sync.Once
+}
+
+func (g *grant) empty() bool {
+	return len(g.sems) == 0 && len(g.buckets) == 0
+}
+
+func (g *grant) release() {
+	g.once.Do(func() {
+		for _, sem := range g.sems {
+			<-sem
+		}
+	})
+}
+
+func (g *grant) throttle(n int) {
+	var wait time.Duration
+	for _, b := range g.buckets {
+		if w, _ := b.reserve(float64(n), math.MaxInt64); w > wait {
+			wait = w
+		}
+	}
+	time.Sleep(wait)
+}
+
+const chunkSize = 16 * 1024
+
+type limitedConn struct {
+	net.Conn
+	g *grant
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := c.Conn.Read(p)
+	c.g.throttle(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		c.g.throttle(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *limitedConn) Close() error {
+	c.g.release()
+	return c.Conn.Close()
+}
+
+type halfClosable interface {
+	CloseWrite() error
+	CloseRead() error
+}
+
+// limitedHalfConn keeps the tunnel half-closable, so that it is still copied
+// with copyAndClose, and releases it once both halves are closed.
+type limitedHalfConn struct {
+	*limitedConn
+	mu                      sync.Mutex
+	readClosed, writeClosed bool
+}
+
+func (c *limitedHalfConn) CloseWrite() error {
+	c.mu.Lock()
+	c.writeClosed = true
+	if c.readClosed {
+		c.g.release()
+	}
+	c.mu.Unlock()
+	return c.Conn.(halfClosable).CloseWrite()
+}
+
+func (c *limitedHalfConn) CloseRead() error {
+	c.mu.Lock()
+	c.readClosed = true
+	if c.writeClosed {
+		c.g.release()
+	}
+	c.mu.Unlock()
+	return c.Conn.(halfClosable).CloseRead()
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	g *grant
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.g.throttle(n)
+	if err == io.EOF {
+		b.g.release()
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	b.g.release()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,244 @@
+package myproxy_limit_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+	myproxy_limit "github.com/fj9140/myproxy/ext/limit"
+)
+
+func limitedProxy(t *testing.T, rules ...myproxy_limit.Rule) (*httptest.Server, *url.URL) {
+	proxy := myproxy.NewProxyHttpServer()
+	myproxy_limit.New(rules...).Install(proxy)
+	s := httptest.NewServer(proxy)
+	u, _ := url.Parse(s.URL)
+	return s, u
+}
+
+func clientFor(proxyURL *url.URL) *http.Client {
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+}
+
+func status(t *testing.T, client *http.Client, u string) int {
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRequestsPerSecond(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	s, u := limitedProxy(t, myproxy_limit.Rule{RequestsPerSecond: 1, Burst: 2})
+	defer s.Close()
+	client := clientFor(u)
+
+	for i, expected := range []int{200, 200, 429} {
+		if code := status(t, client, target.URL); code != expected {
+			t.Errorf("Request %d: expected %d, got %d", i, expected, code)
+		}
+	}
+}
+
+func TestRequestsPerSecondByUser(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	s, u := limitedProxy(t, myproxy_limit.Rule{Key: myproxy_limit.ByUser, RequestsPerSecond: 1})
+	defer s.Close()
+
+	alice, bob := *u, *u
+	alice.User = url.UserPassword("alice", "x")
+	bob.User = url.UserPassword("bob", "x")
+	if code := status(t, clientFor(&alice), target.URL); code != 200 {
+		t.Error("Expected first request of alice to pass, got", code)
+	}
+	if code := status(t, clientFor(&alice), target.URL); code != 429 {
+		t.Error("Expected second request of alice to be limited, got", code)
+	}
+	if code := status(t, clientFor(&bob), target.URL); code != 200 {
+		t.Error("Expected bob not to be limited by alice, got", code)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	s, u := limitedProxy(t, myproxy_limit.Rule{RequestsPerSecond: 10, Delay: time.Second})
+	defer s.Close()
+	client := clientFor(u)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if code := status(t, client, target.URL); code != 200 {
+			t.Errorf("Request %d: expected delayed request to pass, got %d", i, code)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Error("Expected requests to be delayed, took", elapsed)
+	}
+}
+
+func TestBytesPerSecond(t *testing.T) {
+	body := strings.Repeat("x", 200000)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer target.Close()
+	s, u := limitedProxy(t, myproxy_limit.Rule{BytesPerSecond: 100000})
+	defer s.Close()
+
+	start := time.Now()
+	resp, err := clientFor(u).Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(b) != len(body) {
+		t.Error("Expected the whole body, got", len(b))
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Error("Expected body to be throttled, took", elapsed)
+	}
+}
+
+func connect(t *testing.T, proxyAddr, target string) (net.Conn, int) {
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(c, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, resp.StatusCode
+}
+
+func TestMaxTunnels(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	s, u := limitedProxy(t, myproxy_limit.Rule{MaxTunnels: 1})
+	defer s.Close()
+
+	first, code := connect(t, u.Host, l.Addr().String())
+	if code != 200 {
+		t.Fatal("Expected first tunnel to be accepted, got", code)
+	}
+	second, code := connect(t, u.Host, l.Addr().String())
+	second.Close()
+	if code != 429 {
+		t.Error("Expected second tunnel to be limited, got", code)
+	}
+	first.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, code := connect(t, u.Host, l.Addr().String())
+		c.Close()
+		if code == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected tunnel slot to be released on close, got", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTunnelSlotRace(t *testing.T) {
+	l := myproxy_limit.New(myproxy_limit.Rule{MaxTunnels: 1, Delay: 50 * time.Millisecond})
+	req, _ := http.NewRequest("CONNECT", "https://example.com:443", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	ctx := &myproxy.ProxyCtx{Req: req, Proxy: myproxy.NewProxyHttpServer()}
+
+	first, _ := net.Pipe()
+	defer first.Close()
+	if c := l.TunnelHandler().HandleTunnel(first, ctx); c == first {
+		t.Fatal("Expected the first tunnel to be accounted")
+	}
+
+	// a second CONNECT that passed the HttpsHandler check at the same time
+	second, _ := net.Pipe()
+	defer second.Close()
+	done := make(chan net.Conn, 1)
+	go func() { done <- l.TunnelHandler().HandleTunnel(second, ctx) }()
+	select {
+	case c := <-done:
+		if c != nil || ctx.Resp == nil || ctx.Resp.StatusCode != http.StatusTooManyRequests {
+			t.Error("Expected the tunnel losing the race to be refused with a 429, got", ctx.Resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the tunnel losing the race not to wait forever")
+	}
+}
+
+func TestMaxConcurrentWebsocket(t *testing.T) {
+	ws, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	go func() {
+		for {
+			c, err := ws.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := http.ReadRequest(bufio.NewReader(c)); err == nil {
+				io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			}
+			c.Close()
+		}
+	}()
+	s, _ := limitedProxy(t, myproxy_limit.Rule{MaxConcurrent: 1})
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(c, "GET http://"+ws.Addr().String()+"/ws HTTP/1.1\r\nHost: "+ws.Addr().String()+
+			"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Websocket %d: expected the upgrade, got %d", i, resp.StatusCode)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		io.Copy(ioutil.Discard, br)
+		c.Close()
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,371 @@
+package myproxy_netsim
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/fj9140/myproxy"
+)
+
+// Profile describes the network between the client and the proxy. Latency
+// and Jitter are added once in each direction, bandwidths are in bytes per
+// second, zero meaning unlimited. Loss is the probability that a chunk has
+// to be retransmitted, delaying it and everything after it. Every
+// StallEvery the link stops delivering anything for StallFor.
+type Profile struct {
+	Name               string
+	Latency            time.Duration
+	Jitter             time.Duration
+	DownBytesPerSecond int64
+	UpBytesPerSecond   int64
+	Loss               float64
+	StallEvery         time.Duration
+	StallFor           time.Duration
+}
+
+var (
+	Profile3G = Profile{
+		Name:               "3g",
+		Latency:            100 * time.Millisecond,
+		Jitter:             50 * time.Millisecond,
+		DownBytesPerSecond: 750 * 1000 / 8,
+		UpBytesPerSecond:   250 * 1000 / 8,
+	}
+	ProfileLossyWiFi = Profile{
+		Name:               "lossy-wifi",
+		Latency:            20 * time.Millisecond,
+		Jitter:             80 * time.Millisecond,
+		DownBytesPerSecond: 20 * 1000 * 1000 / 8,
+		UpBytesPerSecond:   5 * 1000 * 1000 / 8,
+		Loss:               0.05,
+		StallEvery:         10 * time.Second,
+		StallFor:           time.Second,
+	}
+	ProfileSatellite = Profile{
+		Name:               "satellite",
+		Latency:            300 * time.Millisecond,
+		Jitter:             40 * time.Millisecond,
+		DownBytesPerSecond: 10 * 1000 * 1000 / 8,
+		UpBytesPerSecond:   1000 * 1000 / 8,
+		StallEvery:         30 * time.Second,
+		StallFor:           2 * time.Second,
+	}
+)
+
+var Profiles = map[string]Profile{
+	Profile3G.Name:        Profile3G,
+	ProfileLossyWiFi.Name: ProfileLossyWiFi,
+	ProfileSatellite.Name: ProfileSatellite,
+}
+
+// Install applies the profile to requests and CONNECT tunnels matching
+// conds. Requests read from a tunnel already shaped are left alone.
+func (p Profile) Install(proxy *ProxyHttpServer, conds ...ReqCondition) {
+	proxy.OnRequest(conds...).DoTunnel(p.TunnelHandler())
+	inTunnel := func(ctx *ProxyCtx) bool {
+		if ctx.ConnectCtx == nil {
+			return false
+		}
+		for _, cond := range conds {
+			if !cond.HandleReq(ctx.ConnectCtx.Req, ctx.ConnectCtx) {
+				return false
+			}
+		}
+		return true
+	}
+	req, resp := p.ReqHandler(), p.RespHandler()
+	proxy.OnRequest(conds...).DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if inTunnel(ctx) {
+			return r, nil
+		}
+		return req.Handle(r, ctx)
+	})
+	respConds := make([]RespCondition, len(conds))
+	for i, cond := range conds {
+		respConds[i] = cond
+	}
+	proxy.OnResponse(respConds...).DoFunc(func(r *http.Response, ctx *ProxyCtx) *http.Response {
+		if inTunnel(ctx) {
+			return r
+		}
+		return resp.Handle(r, ctx)
+	})
+}
+
+// ReqHandler delays the request by the uplink latency and shapes its body.
+func (p Profile) ReqHandler() ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		up := p.newLink(p.UpBytesPerSecond)
+		time.Sleep(time.Until(up.schedule(0)))
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = newDelayedReader(req.Body, up)
+		}
+		return req, nil
+	})
+}
+
+// RespHandler delays the response headers by the downlink latency and
+// shapes its body.
+func (p Profile) RespHandler() RespHandler {
+	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp == nil {
+			return resp
+		}
+		down := p.newLink(p.DownBytesPerSecond)
+		time.Sleep(time.Until(down.schedule(0)))
+		if resp.Body != nil {
+			resp.Body = newDelayedReader(resp.Body, down)
+		}
+		return resp
+	})
+}
+
+// TunnelHandler shapes both directions of the tunnel byte stream, whether
+// it is MITM'd or not.
+func (p Profile) TunnelHandler() TunnelHandler {
+	return FuncTunnelHandler(func(client net.Conn, ctx *ProxyCtx) net.Conn {
+		c := &simConn{
+			Conn: client,
+			r:    newDelayedReader(client, p.newLink(p.UpBytesPerSecond)),
+			w:    newDelayedWriter(client, p.newLink(p.DownBytesPerSecond)),
+		}
+		if _, ok := client.(halfClosable); ok {
+			return &simHalfConn{c}
+		}
+		return c
+	})
+}
+
+// link computes when chunks sent in one direction get delivered. Chunks are
+// serialized at the link bandwidth and never overtake each other.
+type link struct {
+	p     Profile
+	bps   int64
+	start time.Time
+
+	mu        sync.Mutex
+	rnd       *rand.Rand
+	busyUntil time.Time
+	delivered time.Time
+}
+
+func (p Profile) newLink(bps int64) *link {
+	now := time.Now()
+	return &link{p: p, bps: bps, start: now, rnd: rand.New(rand.NewSource(now.UnixNano()))}
+}
+
+func (l *link) schedule(n int) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	sent := now
+	if l.busyUntil.After(sent) {
+		sent = l.busyUntil
+	}
+	if l.bps > 0 {
+		sent = sent.Add(time.Duration(int64(n) * int64(time.Second) / l.bps))
+	}
+	l.busyUntil = sent
+
+	at := sent.Add(l.p.Latency)
+	if l.p.Jitter > 0 {
+		at = at.Add(time.Duration(l.rnd.Int63n(int64(l.p.Jitter))))
+	}
+	if l.p.Loss > 0 && l.rnd.Float64() < l.p.Loss {
+		rto := 3 * l.p.Latency
+		if rto < 200*time.Millisecond {
+			rto = 200 * time.Millisecond
+		}
+		at = at.Add(rto)
+	}
+	if l.p.StallEvery > 0 && l.p.StallFor > 0 {
+		period := l.p.StallEvery + l.p.StallFor
+		if offset := at.Sub(l.start) % period; offset >= l.p.StallEvery {
+			at = at.Add(period - offset)
+		}
+	}
+	if at.Before(l.delivered) {
+		at = l.delivered
+	}
+	l.delivered = at
+	return at
+}
+
+const (
+	chunkSize  = 16 * 1024
+	queueDepth = 64
+)
+
+type chunk struct {
+	b  []byte
+	at time.Time
+}
+
+// delayedReader reads ahead from r and hands out what it read once the link
+// delivered it.
+type delayedReader struct {
+	r     io.ReadCloser
+	queue chan chunk
+	stop  chan struct{}
+	once  sync.Once
+	cur   chunk
+	err   error
+}
+
+func newDelayedReader(r io.ReadCloser, l *link) *delayedReader {
+	d := &delayedReader{r: r, queue: make(chan chunk, queueDepth), stop: make(chan struct{})}
+	go d.readAhead(l)
+	return d
+}
+
+func (d *delayedReader) readAhead(l *link) {
+	defer close(d.queue)
+	for {
+		b := make([]byte, chunkSize)
+		n, err := d.r.Read(b)
+		if n > 0 {
+			select {
+			case d.queue <- chunk{b: b[:n], at: l.schedule(n)}:
+			case <-d.stop:
+				return
+			}
+		}
+		if err != nil {
+			d.err = err
+			return
+		}
+	}
+}
+
+func (d *delayedReader) Read(p []byte) (int, error) {
+	if len(d.cur.b) == 0 {
+		c, ok := <-d.queue
+		if !ok {
+			if d.err == nil {
+				return 0, io.EOF
+			}
+			return 0, d.err
+		}
+		time.Sleep(time.Until(c.at))
+		d.cur = c
+	}
+	n := copy(p, d.cur.b)
+	d.cur.b = d.cur.b[n:]
+	return n, nil
+}
+
+func (d *delayedReader) Close() error {
+	d.once.Do(func() { close(d.stop) })
+	return d.r.Close()
+}
+
+// delayedWriter returns as soon as a chunk is queued and writes it to w once
+// the link delivered it.
+type delayedWriter struct {
+	w     io.Writer
+	l     *link
+	queue chan chunk
+	done  chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+
+	errMu sync.Mutex
+	err   error
+}
+
+func newDelayedWriter(w io.Writer, l *link) *delayedWriter {
+	d := &delayedWriter{w: w, l: l, queue: make(chan chunk, queueDepth), done: make(chan struct{})}
+	go d.deliver()
+	return d
+}
+
+func (d *delayedWriter) deliver() {
+	defer close(d.done)
+	for c := range d.queue {
+		time.Sleep(time.Until(c.at))
+		if _, err := d.w.Write(c.b); err != nil {
+			d.errMu.Lock()
+			d.err = err
+			d.errMu.Unlock()
+			for range d.queue {
+			}
+			return
+		}
+	}
+}
+
+func (d *delayedWriter) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return 0, net.ErrClosed
+	}
+	written := 0
+	for len(p) > 0 {
+		d.errMu.Lock()
+		err := d.err
+		d.errMu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		n := len(p)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		d.queue <- chunk{b: append([]byte(nil), p[:n]...), at: d.l.schedule(n)}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// flush waits for everything written to be delivered.
+func (d *delayedWriter) flush() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+	<-d.done
+}
+
+type halfClosable interface {
+	CloseWrite() error
+	CloseRead() error
+}
+
+type simConn struct {
+	net.Conn
+	r *delayedReader
+	w *delayedWriter
+}
+
+func (c *simConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *simConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+func (c *simConn) Close() error {
+	c.w.flush()
+	return c.r.Close()
+}
+
+// simHalfConn keeps the tunnel half-closable, so that it is still copied
+// with copyAndClose.
+type simHalfConn struct {
+	*simConn
+}
+
+func (c *simHalfConn) CloseWrite() error {
+	c.w.flush()
+	return c.Conn.(halfClosable).CloseWrite()
+}
+
+func (c *simHalfConn) CloseRead() error {
+	c.r.once.Do(func() { close(c.r.stop) })
+	return c.Conn.(halfClosable).CloseRead()
+}
@@ -0,0 +1,114 @@
+package myproxy_netsim_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+	myproxy_netsim "github.com/fj9140/myproxy/ext/netsim"
+)
+
+func simProxy(p myproxy_netsim.Profile) *httptest.Server {
+	proxy := myproxy.NewProxyHttpServer()
+	p.Install(proxy)
+	return httptest.NewServer(proxy)
+}
+
+func TestLatency(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "bobo")
+	}))
+	defer target.Close()
+	s := simProxy(myproxy_netsim.Profile{Latency: 100 * time.Millisecond})
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+
+	start := time.Now()
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "bobo" {
+		t.Error("Expected bobo, got", string(b))
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Error("Expected a round trip of at least twice the latency, took", elapsed)
+	}
+}
+
+func TestDownBandwidth(t *testing.T) {
+	body := strings.Repeat("x", 50000)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer target.Close()
+	s := simProxy(myproxy_netsim.Profile{DownBytesPerSecond: 100000})
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+
+	start := time.Now()
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != body {
+		t.Error("Expected the whole body, got", len(b))
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Error("Expected the body to be shaped, took", elapsed)
+	}
+}
+
+func TestTunnelLatency(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	s := simProxy(myproxy_netsim.Profile{Latency: 100 * time.Millisecond})
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "CONNECT "+l.Addr().String()+" HTTP/1.1\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Expected CONNECT to succeed", err)
+	}
+
+	start := time.Now()
+	io.WriteString(c, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Fatal("Expected ping back through the tunnel", string(buf), err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Error("Expected the tunnel to add latency both ways, took", elapsed)
+	}
+}
@@ -2,6 +2,12 @@ module github.com/fj9140/myproxy
 
 go 1.18
 
-require github.com/fj9140/myproxy/ext v0.0.0-20221231100930-c8dba5e40f32
+require (
+	github.com/fj9140/myproxy/ext v0.0.0-20221231100930-c8dba5e40f32
+	golang.org/x/net v0.17.0
+)
 
-require github.com/fj9140/myproxy/regretable v0.0.0-20221231094736-95cf3d97a458 // indirect
+require (
+	github.com/fj9140/myproxy/regretable v0.0.0-20221231094736-95cf3d97a458 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
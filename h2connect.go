@@ -0,0 +1,295 @@
+package myproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errH2Unsupported = errors.New("upstream proxy does not support HTTP/2")
+
+// NewConnectDialToProxyH2 returns a dialer that opens tunnels as HTTP/2
+// CONNECT streams (RFC 7540 section 8.3) to an https:// upstream proxy.
+// Tunnels share the HTTP/2 connections kept by an internal transport, which
+// also takes care of flow control. When the proxy does not negotiate h2 the
+// dialer falls back to HTTP/1.1 CONNECT.
+func (proxy *ProxyHttpServer) NewConnectDialToProxyH2(https_proxy string, auth *ProxyAuth) func(network, addr string) (net.Conn, error) {
+	return proxy.newConnectDialToProxyH2(https_proxy, auth).withoutContext()
+}
+
+func (proxy *ProxyHttpServer) newConnectDialToProxyH2(https_proxy string, auth *ProxyAuth) dialContextFunc {
+	u, err := url.Parse(https_proxy)
+	if err != nil || u.Scheme != "https" {
+		return nil
+	}
+	if auth == nil && u.User != nil {
+		pass, _ := u.User.Password()
+		auth = &ProxyAuth{Username: u.User.Username(), Password: pass, Preemptive: true}
+	}
+	fallback := proxy.newConnectDialToProxy(https_proxy, nil, auth)
+	proxyHost := upstreamHostPort(u)
+
+	tlsConfig := &tls.Config{}
+	if proxy.Tr.TLSClientConfig != nil {
+		tlsConfig = proxy.Tr.TLSClientConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	tr := &http.Transport{
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := proxy.dialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tc := tls.Client(c, tlsConfig)
+			if err := tc.HandshakeContext(ctx); err != nil {
+				c.Close()
+				return nil, err
+			}
+			if tc.ConnectionState().NegotiatedProtocol != "h2" {
+				tc.Close()
+				return nil, errH2Unsupported
+			}
+			return tc, nil
+		},
+	}
+
+	var noH2 int32
+	return func(c context.Context, network, addr string) (net.Conn, error) {
+		if atomic.LoadInt32(&noH2) == 1 {
+			return fallback(c, network, addr)
+		}
+		conn, err := dialH2Tunnel(c, tr, proxyHost, addr, auth)
+		if errors.Is(err, errH2Unsupported) {
+			atomic.StoreInt32(&noH2, 1)
+			return fallback(c, network, addr)
+		}
+		return conn, err
+	}
+}
+
+// dialH2Tunnel gives up when c ends before the proxy answers. The stream
+// itself outlives c, the way a dialed connection would.
+func dialH2Tunnel(c context.Context, tr *http.Transport, proxyHost, addr string, auth *ProxyAuth) (net.Conn, error) {
+	var st proxyAuthState
+	header := make(http.Header)
+	for round := 0; round < maxProxyAuthRounds; round++ {
+		pr, pw := io.Pipe()
+		req := &http.Request{
+			Method:        http.MethodConnect,
+			URL:           &url.URL{Scheme: "https", Host: proxyHost},
+			Host:          addr,
+			Header:        header,
+			Body:          pr,
+			ContentLength: -1,
+		}
+		if round == 0 && auth != nil {
+			if authz := auth.initial(req, &proxyConn{}); authz != "" {
+				header.Set("Proxy-Authorization", authz)
+			}
+		}
+		resp, err := roundTripUntil(c, tr, req)
+		if err != nil {
+			pw.Close()
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return newH2TunnelConn(resp.Body, pw, tunnelAddr(addr)), nil
+		}
+		pw.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusProxyAuthRequired || auth == nil {
+			return nil, refused(resp.StatusCode, body)
+		}
+		next, err := auth.answer(resp.Header.Values("Proxy-Authenticate"), req, &st)
+		if err != nil {
+			return nil, err
+		}
+		if next == "" || strings.HasPrefix(next, "NTLM ") {
+			return nil, refused(resp.StatusCode, body)
+		}
+		header = make(http.Header)
+		header.Set("Proxy-Authorization", next)
+	}
+	return nil, refused(http.StatusProxyAuthRequired, []byte(": too many authentication rounds"))
+}
+
+// roundTripUntil cancels req when c ends before the response headers, and
+// only then.
+func roundTripUntil(c context.Context, tr http.RoundTripper, req *http.Request) (*http.Response, error) {
+	rc, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	answered, canceled := false, false
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-c.Done():
+			mu.Lock()
+			if !answered {
+				canceled = true
+				cancel()
+			}
+			mu.Unlock()
+		case <-stop:
+		}
+	}()
+	resp, err := tr.RoundTrip(req.WithContext(rc))
+	mu.Lock()
+	answered = true
+	mu.Unlock()
+	if canceled {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, c.Err()
+	}
+	if err != nil {
+		cancel()
+	}
+	return resp, err
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tcp" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// h2TunnelConn is a net.Conn over a single HTTP/2 CONNECT stream.
+type h2TunnelConn struct {
+	r         io.ReadCloser
+	w         *io.PipeWriter
+	remote    net.Addr
+	deadlines streamDeadlines
+}
+
+func newH2TunnelConn(r io.ReadCloser, w *io.PipeWriter, remote net.Addr) *h2TunnelConn {
+	c := &h2TunnelConn{r: r, w: w, remote: remote}
+	c.deadlines.expire = func() { c.Close() }
+	return c
+}
+
+func (c *h2TunnelConn) Read(p []byte) (int, error) {
+	if c.deadlines.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := c.r.Read(p)
+	return n, c.deadlines.err(err)
+}
+
+func (c *h2TunnelConn) Write(p []byte) (int, error) {
+	if c.deadlines.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := c.w.Write(p)
+	return n, c.deadlines.err(err)
+}
+
+func (c *h2TunnelConn) CloseWrite() error { return c.w.Close() }
+func (c *h2TunnelConn) CloseRead() error  { return c.r.Close() }
+
+func (c *h2TunnelConn) Close() error {
+	c.deadlines.stop()
+	c.w.Close()
+	return c.r.Close()
+}
+
+func (c *h2TunnelConn) LocalAddr() net.Addr  { return tunnelAddr("") }
+func (c *h2TunnelConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *h2TunnelConn) SetDeadline(t time.Time) error {
+	c.deadlines.setRead(t)
+	c.deadlines.setWrite(t)
+	return nil
+}
+
+func (c *h2TunnelConn) SetReadDeadline(t time.Time) error {
+	c.deadlines.setRead(t)
+	return nil
+}
+
+func (c *h2TunnelConn) SetWriteDeadline(t time.Time) error {
+	c.deadlines.setWrite(t)
+	return nil
+}
+
+// streamDeadlines give deadlines to streams whose blocked reads and writes
+// can only be interrupted by closing them. Once a deadline passes, expire
+// closes the stream and its reads and writes fail with
+// os.ErrDeadlineExceeded; unlike with a net.Conn, the stream cannot be used
+// again.
+type streamDeadlines struct {
+	mu      sync.Mutex
+	read    *time.Timer
+	write   *time.Timer
+	passed  bool
+	stopped bool
+	expire  func()
+}
+
+func (d *streamDeadlines) setRead(t time.Time)  { d.set(&d.read, t) }
+func (d *streamDeadlines) setWrite(t time.Time) { d.set(&d.write, t) }
+
+func (d *streamDeadlines) set(timer **time.Timer, t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if t.IsZero() || d.stopped || d.passed {
+		return
+	}
+	*timer = time.AfterFunc(time.Until(t), d.fire)
+}
+
+func (d *streamDeadlines) fire() {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	d.passed = true
+	d.mu.Unlock()
+	d.expire()
+}
+
+// stop drops the timers once the stream is closed.
+func (d *streamDeadlines) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = true
+	for _, timer := range []*time.Timer{d.read, d.write} {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (d *streamDeadlines) expired() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.passed
+}
+
+func (d *streamDeadlines) err(err error) error {
+	if err != nil && d.expired() {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
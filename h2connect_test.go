@@ -0,0 +1,134 @@
+package myproxy_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+type h2ConnectProxy struct {
+	mu      sync.Mutex
+	remotes map[string]bool
+	protos  map[string]bool
+}
+
+func (p *h2ConnectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.remotes[r.RemoteAddr] = true
+	p.protos[r.Proto] = true
+	p.mu.Unlock()
+	if r.Method != "CONNECT" || r.ProtoMajor != 2 {
+		http.Error(w, "expected HTTP/2 CONNECT", http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	go func() {
+		io.Copy(target, r.Body)
+		target.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(flushWriter{w}, target)
+}
+
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.w.(http.Flusher).Flush()
+	return n, err
+}
+
+func TestConnectDialToProxyH2(t *testing.T) {
+	h2proxy := &h2ConnectProxy{remotes: make(map[string]bool), protos: make(map[string]bool)}
+	upstream := httptest.NewUnstartedServer(h2proxy)
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.ConnectDial = proxy.NewConnectDialToProxyH2(upstream.URL, nil)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for i := 0; i < 5; i++ {
+		if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+			t.Error("Expected bobo through HTTP/2 CONNECT upstream, got", r)
+		}
+		client.CloseIdleConnections()
+	}
+	if len(h2proxy.remotes) != 1 || !h2proxy.protos["HTTP/2.0"] {
+		t.Errorf("Expected every tunnel to share one HTTP/2 connection, got %v %v", h2proxy.remotes, h2proxy.protos)
+	}
+}
+
+func TestConnectDialToProxyH2Fallback(t *testing.T) {
+	upstream := httptest.NewTLSServer(doublingProxy(t))
+	defer upstream.Close()
+
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.ConnectDial = proxy.NewConnectDialToProxyH2(upstream.URL, nil)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo bobo" {
+		t.Error("Expected fallback to HTTP/1.1 CONNECT, got", r)
+	}
+}
+
+func TestH2TunnelDeadline(t *testing.T) {
+	h2proxy := &h2ConnectProxy{remotes: make(map[string]bool), protos: make(map[string]bool)}
+	upstream := httptest.NewUnstartedServer(h2proxy)
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	defer silent.Close()
+	go func() {
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	proxy := myproxy.NewProxyHttpServer()
+	c, err := proxy.NewConnectDialToProxyH2(upstream.URL, nil)("tcp", silent.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !isTimeout(err) {
+			t.Error("Expected the read to time out, got", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the read deadline to interrupt the read")
+	}
+	if _, err := c.Write([]byte("x")); !isTimeout(err) {
+		t.Error("Expected the stream to be closed after its deadline, got", err)
+	}
+}
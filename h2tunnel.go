@@ -0,0 +1,163 @@
+package myproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// h2ServerConn exposes an HTTP/2 CONNECT stream as the client connection of
+// handleHttps. Whatever the CONNECT actions write as an HTTP/1 status line
+// and headers is turned into the HTTP/2 response headers, the rest of the
+// bytes become DATA frames.
+type h2ServerConn struct {
+	w    http.ResponseWriter
+	r    *http.Request
+	body io.ReadCloser
+
+	mu          sync.Mutex
+	wroteHeader bool
+	closed      bool
+	head        []byte
+	done        chan struct{}
+	closeOnce   sync.Once
+	deadlines   streamDeadlines
+}
+
+func newH2ServerConn(w http.ResponseWriter, r *http.Request) *h2ServerConn {
+	c := &h2ServerConn{w: w, r: r, body: r.Body, done: make(chan struct{})}
+	c.deadlines.expire = func() { c.Close() }
+	return c
+}
+
+func (c *h2ServerConn) Read(p []byte) (int, error) {
+	if c.deadlines.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := c.body.Read(p)
+	return n, c.deadlines.err(err)
+}
+
+func (c *h2ServerConn) Write(p []byte) (int, error) {
+	if c.deadlines.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	n := len(p)
+	if !c.wroteHeader {
+		c.head = append(c.head, p...)
+		if !bytes.HasPrefix(c.head, []byte("HTTP/")) && len(c.head) >= len("HTTP/") {
+			c.writeHeader(http.StatusOK, nil)
+			p, c.head = c.head, nil
+		} else if end := bytes.Index(c.head, []byte("\r\n\r\n")); end >= 0 {
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.head[:end+4])), nil)
+			if err != nil {
+				return 0, err
+			}
+			c.writeHeader(resp.StatusCode, resp.Header)
+			p, c.head = c.head[end+4:], nil
+		} else {
+			return n, nil
+		}
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+	if _, err := c.w.Write(p); err != nil {
+		return 0, err
+	}
+	c.w.(http.Flusher).Flush()
+	return n, nil
+}
+
+func (c *h2ServerConn) writeHeader(status int, header http.Header) {
+	for k, vs := range header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Connection", "Proxy-Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade":
+			continue
+		}
+		for _, v := range vs {
+			c.w.Header().Add(k, v)
+		}
+	}
+	c.w.WriteHeader(status)
+	c.w.(http.Flusher).Flush()
+	c.wroteHeader = true
+}
+
+func (c *h2ServerConn) Close() error {
+	c.deadlines.stop()
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.body.Close()
+}
+
+// wait blocks until the tunnel is closed or the client goes away, the
+// stream must stay open for as long as the handler runs.
+func (c *h2ServerConn) wait() {
+	select {
+	case <-c.done:
+	case <-c.r.Context().Done():
+	}
+	c.mu.Lock()
+	c.closed = true
+	if !c.wroteHeader {
+		c.writeHeader(http.StatusBadGateway, nil)
+	}
+	c.mu.Unlock()
+}
+
+func (c *h2ServerConn) LocalAddr() net.Addr {
+	if addr, ok := c.r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return tunnelAddr("")
+}
+
+func (c *h2ServerConn) RemoteAddr() net.Addr { return tunnelAddr(c.r.RemoteAddr) }
+
+// SetDeadline and friends close the stream once their deadline passes, see
+// streamDeadlines.
+func (c *h2ServerConn) SetDeadline(t time.Time) error {
+	c.deadlines.setRead(t)
+	c.deadlines.setWrite(t)
+	return nil
+}
+
+func (c *h2ServerConn) SetReadDeadline(t time.Time) error {
+	c.deadlines.setRead(t)
+	return nil
+}
+
+func (c *h2ServerConn) SetWriteDeadline(t time.Time) error {
+	c.deadlines.setWrite(t)
+	return nil
+}
+
+// NewTLSServer returns a server exposing the proxy over TLS, so that clients
+// can use it as an https:// proxy. Both HTTP/1.1 and HTTP/2 CONNECT are
+// accepted. When clientCAs is not nil, clients must present a certificate
+// signed by one of them. Serve it with ListenAndServeTLS("", "").
+func (proxy *ProxyHttpServer) NewTLSServer(addr string, cert tls.Certificate, clientCAs *x509.CertPool) *http.Server {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &http.Server{Addr: addr, Handler: proxy, TLSConfig: config}
+}
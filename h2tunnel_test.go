@@ -0,0 +1,131 @@
+package myproxy_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+func TestHttpsProxyAcceptsH2Connect(t *testing.T) {
+	for _, mitm := range []bool{false, true} {
+		proxy := myproxy.NewProxyHttpServer()
+		expected := "bobo"
+		if mitm {
+			proxy = doublingProxy(t)
+			expected = "bobo bobo"
+		}
+		tlsProxy := httptest.NewUnstartedServer(proxy)
+		tlsProxy.EnableHTTP2 = true
+		tlsProxy.StartTLS()
+		defer tlsProxy.Close()
+
+		front := myproxy.NewProxyHttpServer()
+		front.ConnectDial = front.NewConnectDialToProxyH2(tlsProxy.URL, nil)
+		client, l := oneShotProxy(front, t)
+		defer l.Close()
+
+		for i := 0; i < 2; i++ {
+			if r := string(getOrFail(https.URL+"/bobo", client, t)); r != expected {
+				t.Errorf("Expected %s through HTTP/2 CONNECT to the proxy, got %s", expected, r)
+			}
+			client.CloseIdleConnections()
+		}
+	}
+}
+
+func TestHttpsProxyAcceptsHTTP1Connect(t *testing.T) {
+	tlsProxy := httptest.NewUnstartedServer(doublingProxy(t))
+	tlsProxy.EnableHTTP2 = true
+	tlsProxy.StartTLS()
+	defer tlsProxy.Close()
+
+	proxyURL, _ := url.Parse(tlsProxy.URL)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: acceptAllCerts, Proxy: http.ProxyURL(proxyURL)}}
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo bobo" {
+		t.Error("Expected bobo bobo through HTTP/1.1 CONNECT over TLS, got", r)
+	}
+}
+
+func TestTLSServerRequiresClientCert(t *testing.T) {
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(myproxy.MyproxyCa.Leaf)
+	proxy := myproxy.NewProxyHttpServer()
+	server := proxy.NewTLSServer("", myproxy.MyproxyCa, clientCAs)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	go server.ServeTLS(l, "", "")
+	defer server.Close()
+
+	proxyURL, _ := url.Parse("https://" + l.Addr().String())
+	withCert := &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{myproxy.MyproxyCa}}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: withCert, Proxy: http.ProxyURL(proxyURL)}}
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected bobo with a client certificate, got", r)
+	}
+
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: acceptAllCerts, Proxy: http.ProxyURL(proxyURL)}}
+	if _, err := client.Get(https.URL + "/bobo"); err == nil {
+		t.Error("Expected the proxy to refuse clients without a certificate")
+	}
+}
+
+func TestH2TunnelTimeouts(t *testing.T) {
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	defer silent.Close()
+	go func() {
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	for name, configure := range map[string]func(proxy *myproxy.ProxyHttpServer){
+		"idle": func(proxy *myproxy.ProxyHttpServer) {
+			proxy.TunnelIdleTimeout = 100 * time.Millisecond
+		},
+		"header read": func(proxy *myproxy.ProxyHttpServer) {
+			proxy.HeaderReadTimeout = 100 * time.Millisecond
+			proxy.OnRequest().HandleConnect(myproxy.FuncHttpsHandler(func(host string, ctx *myproxy.ProxyCtx) (*myproxy.ConnectAction, string) {
+				return myproxy.HTTPMitmConnect, host
+			}))
+		},
+	} {
+		proxy := myproxy.NewProxyHttpServer()
+		configure(proxy)
+		tlsProxy := httptest.NewUnstartedServer(proxy)
+		tlsProxy.EnableHTTP2 = true
+		tlsProxy.StartTLS()
+
+		front := myproxy.NewProxyHttpServer()
+		c, err := front.NewConnectDialToProxyH2(tlsProxy.URL, nil)("tcp", silent.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			_, err := c.Read(make([]byte, 1))
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("%s: expected the tunnel to be closed", name)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s: expected the idle HTTP/2 tunnel to be closed", name)
+		}
+		c.Close()
+		tlsProxy.Close()
+	}
+}
@@ -0,0 +1,34 @@
+package myproxy
+
+import "net/http"
+
+// OnResponse registers f to handle the response to the request of ctx only,
+// after the response handlers of the proxy. As them, f is called with a nil
+// response and ctx.Error set when the request failed.
+//
+//	proxy.OnRequest(myproxy.DstHostIs("api.example.com")).DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+//		ctx.OnResponse(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+//			if resp != nil {
+//				resp.Header.Set("Deprecation", "true")
+//			}
+//			return resp
+//		})
+//		return req, nil
+//	})
+func (ctx *ProxyCtx) OnResponse(f func(resp *http.Response, ctx *ProxyCtx) *http.Response) {
+	ctx.respHooks = append(ctx.respHooks, FuncRespHandler(f))
+}
+
+// OnComplete registers f to be called once the exchange of ctx is over: the
+// response was sent, the tunnel closed or the request failed.
+func (ctx *ProxyCtx) OnComplete(f func(ctx *ProxyCtx)) {
+	ctx.completeHooks = append(ctx.completeHooks, f)
+}
+
+func (proxy *ProxyHttpServer) runCompleteHooks(ctx *ProxyCtx) {
+	hooks := ctx.completeHooks
+	ctx.completeHooks = nil
+	for _, f := range hooks {
+		proxy.protect(ctx, "complete", func() { f(ctx) })
+	}
+}
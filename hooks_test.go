@@ -0,0 +1,212 @@
+package myproxy_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+func hookedProxy(completed chan string) *myproxy.ProxyHttpServer {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if !strings.HasSuffix(req.URL.Path, "/hooked") {
+			return req, nil
+		}
+		ctx.OnResponse(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+			resp.Header.Set("X-Hook", "after "+resp.Header.Get("X-Global"))
+			return resp
+		})
+		ctx.OnComplete(func(ctx *myproxy.ProxyCtx) {
+			completed <- ctx.Req.URL.Path
+		})
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Global", "global")
+		return resp
+	})
+	return proxy
+}
+
+func expectCompleted(t *testing.T, completed chan string, path string) {
+	select {
+	case u := <-completed:
+		if u != path {
+			t.Errorf("Expected %s to complete, got %s", path, u)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected OnComplete to be called for", path)
+	}
+}
+
+func TestCtxHooks(t *testing.T) {
+	completed := make(chan string, 1)
+	proxy := hookedProxy(completed)
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, base := range []string{srv.URL, https.URL} {
+		resp, err := client.Get(base + "/hooked")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if h := resp.Header.Get("X-Hook"); h != "after global" {
+			t.Errorf("Expected the hook to run after the global handlers for %s, got %q", base, h)
+		}
+		expectCompleted(t, completed, "/hooked")
+
+		resp, err = client.Get(base + "/other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if h := resp.Header.Get("X-Hook"); h != "" {
+			t.Errorf("Expected the hook to be scoped to its request, got %q on %s/other", h, base)
+		}
+	}
+}
+
+func TestCtxHooksHTTPMitm(t *testing.T) {
+	completed := make(chan string, 1)
+	proxy := hookedProxy(completed)
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *myproxy.ProxyCtx) (*myproxy.ConnectAction, string) {
+		return myproxy.HTTPMitmConnect, host
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	host := srv.Listener.Addr().String()
+	c, _ := connectThrough(t, l, host)
+	defer c.Close()
+	fmt.Fprintf(c, "GET /hooked HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if h := resp.Header.Get("X-Hook"); h != "after global" {
+		t.Errorf("Expected the hook to run in HTTP MITM tunnels, got %q", h)
+	}
+	expectCompleted(t, completed, "/hooked")
+}
+
+// hookedExchange sends a GET of path to host through the proxy behind l,
+// plain, through an HTTP MITM tunnel or through a TLS MITM one.
+func hookedExchange(t *testing.T, l *httptest.Server, mode, host, path string) (net.Conn, *http.Response) {
+	var c net.Conn
+	uri := path
+	switch mode {
+	case "plain":
+		var err error
+		if c, err = net.Dial("tcp", l.Listener.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		uri = "http://" + host + path
+	case "http mitm":
+		c, _ = connectThrough(t, l, host)
+	case "tls mitm":
+		raw, _ := connectThrough(t, l, host)
+		c = tls.Client(raw, acceptAllCerts)
+	}
+	fmt.Fprintf(c, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", uri, host)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	return c, resp
+}
+
+func TestCtxHooksClientGone(t *testing.T) {
+	endless := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 32*1024)
+		for i := 0; i < 1000; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	endless.StartTLS()
+	defer endless.Close()
+	plain := httptest.NewServer(endless.Config.Handler)
+	defer plain.Close()
+
+	for _, mode := range []string{"plain", "http mitm", "tls mitm"} {
+		completed := make(chan string, 2)
+		proxy := hookedProxy(completed)
+		proxy.OnRequest().HandleConnect(myproxy.FuncHttpsHandler(func(host string, ctx *myproxy.ProxyCtx) (*myproxy.ConnectAction, string) {
+			if host == endless.Listener.Addr().String() {
+				return myproxy.MitmConnect, host
+			}
+			return myproxy.HTTPMitmConnect, host
+		}))
+		_, l := oneShotProxy(proxy, t)
+
+		host := plain.Listener.Addr().String()
+		if mode == "tls mitm" {
+			host = endless.Listener.Addr().String()
+		}
+		c, resp := hookedExchange(t, l, mode, host, "/hooked")
+		io.ReadFull(resp.Body, make([]byte, 1024))
+		c.Close()
+		expectCompleted(t, completed, "/hooked")
+		select {
+		case <-completed:
+			t.Errorf("%s: expected OnComplete to be called once", mode)
+		case <-time.After(100 * time.Millisecond):
+		}
+		l.Close()
+	}
+}
+
+func TestFallbackResponseMitm(t *testing.T) {
+	closing, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	defer closing.Close()
+	go func() {
+		for {
+			c, err := closing.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	for _, mode := range []string{"http mitm", "tls mitm"} {
+		proxy := myproxy.NewProxyHttpServer()
+		proxy.OnRequest().HandleConnect(myproxy.FuncHttpsHandler(func(host string, ctx *myproxy.ProxyCtx) (*myproxy.ConnectAction, string) {
+			if mode == "tls mitm" {
+				return myproxy.MitmConnect, host
+			}
+			return myproxy.HTTPMitmConnect, host
+		}))
+		proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+			if resp != nil {
+				return resp
+			}
+			return myproxy.NewResponse(ctx.Req, myproxy.ContentTypeText, http.StatusServiceUnavailable, "fallback")
+		})
+		_, l := oneShotProxy(proxy, t)
+
+		c, resp := hookedExchange(t, l, mode, closing.Addr().String(), "/")
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusServiceUnavailable || string(b) != "fallback" {
+			t.Errorf("%s: expected the fallback response, got %d %q", mode, resp.StatusCode, b)
+		}
+		c.Close()
+		l.Close()
+	}
+}
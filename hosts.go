@@ -0,0 +1,169 @@
+package myproxy
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// NormalizeHost returns the name of host as host conditions compare it:
+// without port, IPv6 brackets or trailing dot, lowercase, with IPs in their
+// canonical form and internationalized names in punycode, so that
+// "Bücher.Example.:443" becomes "xn--bcher-kva.example".
+func NormalizeHost(host string) string {
+	name, _ := splitHost(host)
+	return name
+}
+
+// splitHost normalizes the name of host and returns its port, 0 when it has
+// none.
+func splitHost(host string) (string, int) {
+	name, port := host, ""
+	if strings.HasPrefix(host, "[") {
+		if i := strings.IndexByte(host, ']'); i > 0 {
+			name, port = host[1:i], strings.TrimPrefix(host[i+1:], ":")
+		}
+	} else if strings.Count(host, ":") == 1 {
+		i := strings.IndexByte(host, ':')
+		name, port = host[:i], host[i+1:]
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		p = 0
+	}
+	return normalizeName(name), p
+}
+
+func normalizeName(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if ip := net.ParseIP(name); ip != nil {
+		return ip.String()
+	}
+	name = strings.ToLower(name)
+	if isASCII(name) {
+		return name
+	}
+	// label by label, to keep the wildcards of host patterns
+	labels := strings.Split(name, ".")
+	for i, l := range labels {
+		if isASCII(l) {
+			continue
+		}
+		if ascii, err := idna.Lookup.ToASCII(l); err == nil {
+			labels[i] = ascii
+		}
+	}
+	return strings.TrimSuffix(strings.Join(labels, "."), ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// reqHost returns the normalized destination name and port of req, the
+// default port of its scheme when it has none. MITM'd requests may only
+// have a Host header.
+func reqHost(req *http.Request) (string, int) {
+	host := req.Host
+	if req.URL != nil && req.URL.Host != "" {
+		host = req.URL.Host
+	}
+	name, port := splitHost(host)
+	if port != 0 {
+		return name, port
+	}
+	scheme := ""
+	if req.URL != nil {
+		scheme = strings.ToLower(req.URL.Scheme)
+	}
+	switch {
+	case scheme == "https" || scheme == "wss":
+		port = 443
+	case scheme == "http" || scheme == "ws":
+		port = 80
+	case scheme == "" && req.Method != "CONNECT":
+		port = 80
+		if req.TLS != nil {
+			port = 443
+		}
+	}
+	return name, port
+}
+
+// hostPattern is a pattern of HostIs.
+type hostPattern struct {
+	name   string
+	suffix bool
+	glob   bool
+	port   int
+}
+
+func parseHostPattern(pattern string) hostPattern {
+	var p hostPattern
+	if strings.HasPrefix(pattern, ".") && len(pattern) > 1 {
+		p.suffix = true
+		pattern = pattern[1:]
+	}
+	p.name, p.port = splitHost(pattern)
+	p.glob = strings.ContainsAny(p.name, "*?")
+	return p
+}
+
+func (p hostPattern) match(name string, port int) bool {
+	if p.port != 0 && p.port != port {
+		return false
+	}
+	switch {
+	case p.glob:
+		return globMatch(p.name, name)
+	case p.suffix:
+		return name == p.name || strings.HasSuffix(name, "."+p.name)
+	}
+	return name == p.name
+}
+
+// HostIs matches requests to any of the given hosts, whether in the URL or
+// the Host header of MITM'd requests, or the CONNECT target. Hosts and
+// patterns are compared once normalized by NormalizeHost. A pattern is a
+// name or IP, ".example.com" for example.com and its subdomains, or a glob
+// such as "*.example.com" where * matches any run of characters, subdomains
+// only. Patterns with a port only match that port, the default port of the
+// scheme included, others match any port.
+func HostIs(patterns ...string) ReqConditionFunc {
+	parsed := make([]hostPattern, len(patterns))
+	for i, p := range patterns {
+		parsed[i] = parseHostPattern(p)
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		name, port := reqHost(req)
+		for _, p := range parsed {
+			if p.match(name, port) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// reqHostMatches tells whether re matches the normalized destination of req,
+// with or without its port.
+func reqHostMatches(req *http.Request, re *regexp.Regexp) bool {
+	name, port := reqHost(req)
+	if strings.Contains(name, ":") {
+		name = "[" + name + "]"
+	}
+	if re.MatchString(name) {
+		return true
+	}
+	return port != 0 && re.MatchString(name+":"+strconv.Itoa(port))
+}
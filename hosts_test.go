@@ -0,0 +1,110 @@
+package myproxy_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/fj9140/myproxy"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	for host, expected := range map[string]string{
+		"Example.COM":           "example.com",
+		"example.com.:443":      "example.com",
+		"[2001:DB8:0::1]:8443":  "2001:db8::1",
+		"2001:db8::1":           "2001:db8::1",
+		"[::ffff:10.0.0.1]":     "10.0.0.1",
+		"10.0.0.1:80":           "10.0.0.1",
+		"Bücher.example":        "xn--bcher-kva.example",
+		"münchen.de:443":        "xn--mnchen-3ya.de",
+		"例え。テスト":                "xn--r8jz45g.xn--zckzah",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+	} {
+		if n := myproxy.NormalizeHost(host); n != expected {
+			t.Errorf("Expected %s to normalize to %s, got %s", host, expected, n)
+		}
+	}
+}
+
+func TestHostIs(t *testing.T) {
+	for _, tc := range []struct {
+		pattern  string
+		url      string
+		expected bool
+	}{
+		{"example.com", "https://EXAMPLE.com:443/", true},
+		{"example.com", "http://example.com.:8080/", true},
+		{"example.com", "http://www.example.com/", false},
+		{"example.com:443", "https://example.com/", true},
+		{"example.com:443", "http://example.com/", false},
+		{"example.com:80", "http://example.com/", true},
+		{".corp.example", "http://corp.example/", true},
+		{".corp.example", "http://a.b.corp.example/", true},
+		{".corp.example", "http://notcorp.example/", false},
+		{"*.corp.example", "http://a.corp.example/", true},
+		{"*.corp.example", "http://corp.example/", false},
+		{"api-?.example.com", "http://api-2.example.com/", true},
+		{"[2001:db8::1]", "http://[2001:DB8:0:0::1]:8080/", true},
+		{"2001:db8::1", "http://[2001:db8::1]/", true},
+		{"bücher.example", "http://xn--bcher-kva.example/", true},
+		{"*.bücher.example", "http://www.BÜCHER.example/", true},
+		{"no such host exists", "http://example.com/", false},
+	} {
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		if m := myproxy.HostIs(tc.pattern).HandleReq(req, nil); m != tc.expected {
+			t.Errorf("Expected %s on %s to be %v, got %v", tc.pattern, tc.url, tc.expected, m)
+		}
+	}
+}
+
+func TestHostConditionsAgree(t *testing.T) {
+	connect, _ := http.NewRequest("CONNECT", "", nil)
+	connect.URL.Host, connect.Host = "Example.com:443", "Example.com:443"
+	plain, _ := http.NewRequest("GET", "http://example.com./x", nil)
+	// MITM'd requests have their URL rebuilt from the CONNECT host
+	mitm, _ := http.NewRequest("GET", "https://example.com:443/x", nil)
+	mitm.Host = "example.com"
+	// HTTPMitm requests only have their Host header
+	relative, _ := http.NewRequest("GET", "/x", nil)
+	relative.URL.Host, relative.Host, relative.TLS = "", "EXAMPLE.com", &tls.ConnectionState{}
+
+	conds := map[string]myproxy.ReqCondition{
+		"DstHostIs":      myproxy.DstHostIs("example.com"),
+		"ReqHostIs":      myproxy.ReqHostIs("other.com", "example.com"),
+		"ReqHostMatches": myproxy.ReqHostMatches(regexp.MustCompile(`^example\.com$`)),
+		"expression":     myproxy.MustParseCondition(`host == example.com`),
+		"glob":           myproxy.MustParseCondition(`host ~ "*ample.com" && host in [.example.com]`),
+	}
+	for name, req := range map[string]*http.Request{"connect": connect, "plain": plain, "mitm": mitm, "relative": relative} {
+		ctx := &myproxy.ProxyCtx{Req: req}
+		for cname, cond := range conds {
+			if !cond.HandleReq(req, ctx) || !cond.HandleResp(&http.Response{}, ctx) {
+				t.Errorf("Expected %s to match the %s request", cname, name)
+			}
+		}
+	}
+
+	port443 := myproxy.ReqHostMatches(regexp.MustCompile(`:443$`))
+	if !port443.HandleReq(connect, nil) || !port443.HandleReq(mitm, nil) || !port443.HandleReq(relative, nil) || port443.HandleReq(plain, nil) {
+		t.Error("Expected ReqHostMatches to match hosts with their port")
+	}
+	if _, err := myproxy.ParseCondition(`host == example.com:443`); err == nil {
+		t.Error("Expected an error comparing host with a port")
+	}
+}
+
+func TestHostIsOnConnect(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest(myproxy.HostIs("127.0.0.1")).HandleConnect(myproxy.AlwaysMitm)
+	proxy.OnRequest(myproxy.HostIs("127.0.0.1")).DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, myproxy.NewResponse(req, myproxy.ContentTypeText, http.StatusOK, "matched")
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "matched" {
+		t.Error("Expected the MITM'd request to match its host without port, got", r)
+	}
+}
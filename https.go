@@ -2,12 +2,14 @@ package myproxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
 	"regexp"
@@ -15,10 +17,27 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type ConnectActionLiteral int
 
+func (a ConnectActionLiteral) String() string {
+	switch a {
+	case ConnectAccept:
+		return "accept"
+	case ConnectReject:
+		return "reject"
+	case ConnectMitm:
+		return "mitm"
+	case ConnectHijack:
+		return "hijack"
+	case ConnectHTTPMitm:
+		return "http_mitm"
+	}
+	return strconv.Itoa(int(a))
+}
+
 type ConnectAction struct {
 	Action    ConnectActionLiteral
 	Hijack    func(req *http.Request, client net.Conn, ctx *ProxyCtx)
@@ -41,44 +60,99 @@ var (
 	HTTPMitmConnect = &ConnectAction{Action: ConnectHTTPMitm, TLSConfig: TLSConfigFromCA(&MyproxyCa)}
 )
 
+var errProxyRefused = errors.New("proxy refused connection")
+
+// proxyRefusal is an upstream proxy answering a CONNECT with status, it
+// matches errProxyRefused.
+type proxyRefusal struct {
+	status int
+	msg    string
+}
+
+func refused(status int, body []byte) error {
+	return &proxyRefusal{status: status, msg: errProxyRefused.Error() + string(body)}
+}
+
+func (e *proxyRefusal) Error() string {
+	return e.msg
+}
+
+func (e *proxyRefusal) Is(target error) bool {
+	return target == errProxyRefused
+}
+
 type halfClosable interface {
 	net.Conn
 	CloseWrite() error
 	CloseRead() error
 }
 
-func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
-	if _, err := io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\n\r\n"); err != nil {
-		ctx.Warnf("Error responding to client: %s", err)
-	}
-	if err := w.Close(); err != nil {
-		ctx.Warnf("Error closing client connection: %s", err)
-	}
-}
-
 func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request) {
-	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore}
-
-	hij, ok := w.(http.Hijacker)
-	if !ok {
-		panic("httpserver does not support hijacking")
+	if proxy.closing() {
+		rejectShuttingDown(w)
+		return
 	}
-
-	proxyClient, _, e := hij.Hijack()
-	if e != nil {
-		panic("Cannot hijack connection " + e.Error())
+	ctx := proxy.newCtx(r, nil)
+	ctx.certStore = proxy.CertStore
+
+	var proxyClient net.Conn
+	if hij, ok := w.(http.Hijacker); ok && r.ProtoMajor == 1 {
+		var e error
+		proxyClient, _, e = hij.Hijack()
+		if e != nil {
+			panic("Cannot hijack connection " + e.Error())
+		}
+	} else if r.ProtoMajor == 2 {
+		h2Client := newH2ServerConn(w, r)
+		defer h2Client.wait()
+		proxyClient = h2Client
+	} else {
+		panic("httpserver does not support hijacking")
 	}
 
-	ctx.Logf("Running %d CONNECT handlers", len(proxy.httpsHandlers))
+	proxy.sessions.add(ctx, ctx.cancel)
+	httpsHandlers := ctx.handlers().https
+	ctx.Logf("Running %d CONNECT handlers", len(httpsHandlers))
 	todo, host := OkConnect, r.URL.Host
-	for i, h := range proxy.httpsHandlers {
-		newtodo, newhost := h.HandleConnect(host, ctx)
+	for i, h := range httpsHandlers {
+		var newtodo *ConnectAction
+		var newhost string
+		if p := proxy.protect(ctx, "connect", func() { newtodo, newhost = h.HandleConnect(host, ctx) }); p != nil {
+			proxy.complete(ctx, httpError(proxyClient, ctx, p), 0)
+			return
+		}
 		if newtodo != nil {
 			todo, host = newtodo, newhost
 			ctx.Logf("on %dth handler: %v %s", i, todo, host)
 			break
 		}
 	}
+	ctx.connectAction, ctx.connectSet = todo.Action, true
+	proxy.sessions.setAction(ctx, todo.Action)
+	proxy.Metrics.countConnect(todo.Action)
+	if todo.Action != ConnectReject {
+		if todo.Action != ConnectHijack {
+			ctx.status = http.StatusOK
+		}
+		tunnelClosed := proxy.Metrics.tunnelOpened(todo.Action)
+		proxyClient = proxy.trackConn(proxyClient, ctx, func() {
+			ctx.timers.stop()
+			tunnelClosed()
+			proxy.complete(ctx, ctx.status, atomic.LoadInt64(&ctx.bytesOut))
+		})
+		tracked := proxyClient
+		proxyClient = proxy.filterTunnel(proxyClient, ctx)
+		if _, ok := ctx.Error.(*HandlerPanic); ok {
+			return
+		}
+		if proxyClient == nil {
+			proxy.abortTunnel(tracked, ctx)
+			return
+		}
+		tunnel := proxyClient
+		proxy.sessions.onKill(ctx, func() { tunnel.Close() })
+		proxy.limitLifetime(ctx)
+	}
 	switch todo.Action {
 	case ConnectAccept:
 		if !hasPort.MatchString(host) {
@@ -86,19 +160,25 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 		}
 		targetSiteCon, err := proxy.connectDial(ctx, "tcp", host)
 		if err != nil {
+			proxy.Metrics.countError("dial")
 			httpError(proxyClient, ctx, err)
 			return
 		}
+		proxy.sessions.onKill(ctx, func() { targetSiteCon.Close() })
+		proxy.watchIdle(ctx, func() {
+			proxyClient.Close()
+			targetSiteCon.Close()
+		})
 		ctx.Logf("Accepting CONNECT to %s", host)
 		proxyClient.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
 
 		targetTCP, targetOK := targetSiteCon.(halfClosable)
 		proxyClientTCP, clientOK := proxyClient.(halfClosable)
 		if targetOK && clientOK {
-			go copyAndClose(ctx, targetTCP, proxyClientTCP)
-			go copyAndClose(ctx, proxyClientTCP, targetTCP)
+			proxy.spawn(func() { copyAndClose(ctx, targetTCP, proxyClientTCP) })
+			proxy.spawn(func() { copyAndClose(ctx, proxyClientTCP, targetTCP) })
 		} else {
-			go func() {
+			proxy.spawn(func() {
 				var wg sync.WaitGroup
 				wg.Add(2)
 				go copyOrWarn(ctx, targetSiteCon, proxyClient, &wg)
@@ -106,45 +186,137 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				wg.Wait()
 				proxyClient.Close()
 				targetSiteCon.Close()
-			}()
+			})
 		}
 	case ConnectHijack:
-		todo.Hijack(r, proxyClient, ctx)
+		if p := proxy.protect(ctx, "hijack", func() { todo.Hijack(r, proxyClient, ctx) }); p != nil {
+			proxyClient.Close()
+		}
 	case ConnectHTTPMitm:
+		defer proxyClient.Close()
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 		ctx.Logf("Assumint CONNECT is plain HTTP tunneling, mitm proxying it")
 		targetSiteCon, err := proxy.connectDial(ctx, "tcp", host)
 		if err != nil {
 			ctx.Warnf("Error dialing to %s: %s", host, err.Error())
+			proxy.Metrics.countError("dial")
+			ctx.status = ClassifyError(err).Status()
 			return
 		}
-
+		defer func() { targetSiteCon.Close() }()
+		var targetMu sync.Mutex
+		proxy.sessions.onKill(ctx, func() {
+			targetMu.Lock()
+			defer targetMu.Unlock()
+			targetSiteCon.Close()
+		})
+
+		client := bufio.NewReader(proxyClient)
+		remote := bufio.NewReader(targetSiteCon)
+		reused := false
+		var exchange *ProxyCtx
+		defer func() {
+			if exchange != nil {
+				proxy.abandon(exchange)
+			}
+		}()
 		for {
-			client := bufio.NewReader(proxyClient)
-			remote := bufio.NewReader(targetSiteCon)
+			if proxy.waitRequest(ctx) {
+				return
+			}
+			proxy.setHeaderDeadline(proxyClient, true)
 			req, err := http.ReadRequest(client)
-			if err != nil && err != io.EOF {
+			if err != nil && isTimeout(err) {
+				proxy.timedOut(ctx, "header_read", "Timed out waiting for request headers of MITM HTTP client after %v", proxy.HeaderReadTimeout)
+			} else if err != nil && err != io.EOF {
 				ctx.Warnf("cannot read request of MITM HTTP client: %+#v", err)
 			}
 			if err != nil {
 				return
 			}
+			proxy.setHeaderDeadline(proxyClient, false)
+			proxy.gotRequest(ctx)
+			req.RemoteAddr = r.RemoteAddr
+			ctx := proxy.newCtx(req, ctx)
+			ctx.status, exchange = http.StatusBadGateway, ctx
+			proxy.sessions.setInflight(ctx)
+			span := ctx.trace.start("request handlers", SpanKindInternal, nil)
 			req, resp := proxy.filterRequest(req, ctx)
+			ctx.trace.end(span, nil)
+			failed, sent := false, false
 			if resp == nil {
-				if err := req.Write(targetSiteCon); err != nil {
-					httpError(proxyClient, ctx, err)
-					return
-				}
-				resp, err = http.ReadResponse(remote, req)
+				resp, err = proxy.roundTrip(req, ctx, func(req *http.Request, ctx *ProxyCtx) (resp *http.Response, err error) {
+					if sent {
+						// the previous response may be unread, resend on a new connection
+						c, err := proxy.connectDial(ctx, "tcp", host)
+						if err != nil {
+							return nil, err
+						}
+						targetMu.Lock()
+						targetSiteCon.Close()
+						targetSiteCon = c
+						targetMu.Unlock()
+						remote, reused = bufio.NewReader(c), false
+					}
+					sent = true
+					span := ctx.trace.start("upstream "+req.Method, SpanKindClient, nil)
+					if span != nil {
+						req.Header.Set("traceparent", ctx.trace.traceparent(span))
+					}
+					if d := ctx.getUpstreamTimeout(); d > 0 {
+						targetSiteCon.SetDeadline(time.Now().Add(d))
+					}
+					hooks := ctx.timings.clientTrace()
+					hooks.GotConn(httptrace.GotConnInfo{Reused: reused})
+					reused = true
+					err = req.Write(targetSiteCon)
+					if err == nil {
+						hooks.WroteRequest(httptrace.WroteRequestInfo{})
+						resp, err = http.ReadResponse(remote, req)
+					}
+					ctx.trace.end(span, err)
+					if err != nil && isTimeout(err) {
+						proxy.timedOut(ctx, "upstream", "Upstream did not answer within %v", ctx.getUpstreamTimeout())
+					}
+					if err == nil {
+						hooks.GotFirstResponseByte()
+						timeBody(resp, &ctx.timings)
+					}
+					return resp, err
+				})
 				if err != nil {
-					httpError(proxyClient, ctx, err)
-					return
+					ctx.Error, failed = err, true
+					proxy.Metrics.countError("roundtrip")
+				} else {
+					defer resp.Body.Close()
 				}
-				defer resp.Body.Close()
 			}
+			span = ctx.trace.start("response handlers", SpanKindInternal, nil)
 			resp = proxy.filterResponse(resp, ctx)
-			if err := resp.Write(proxyClient); err != nil {
-				httpError(proxyClient, ctx, err)
+			ctx.trace.end(span, nil)
+			if resp == nil {
+				err := ctx.Error
+				if err == nil {
+					err = errNoResponse
+				}
+				proxy.complete(ctx, httpError(proxyClient, ctx, err), 0)
+				return
+			}
+			ctx.status = resp.StatusCode
+			proxy.addServerTiming(resp.Header, ctx)
+			resp.Body = &countingBody{ReadCloser: resp.Body, n: &ctx.bytesOut}
+			span = ctx.trace.start("copy body", SpanKindInternal, nil)
+			err = resp.Write(proxyClient)
+			ctx.trace.end(span, err)
+			if err != nil {
+				ctx.Warnf("Cannot write response to MITM HTTP client: %v", err)
+				return
+			}
+			targetSiteCon.SetDeadline(time.Time{})
+			proxy.Metrics.countRequest(ctx.Req.Method, resp.StatusCode, ctx.Req.URL.Hostname())
+			proxy.complete(ctx, resp.StatusCode, atomic.LoadInt64(&ctx.bytesOut))
+			if failed {
+				// the target connection is out of step after a failed round trip
 				return
 			}
 		}
@@ -156,21 +328,36 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			var err error
 			tlsConfig, err = todo.TLSConfig(host, ctx)
 			if err != nil {
+				proxy.Metrics.countError("cert")
 				httpError(proxyClient, ctx, err)
 				return
 			}
 		}
-		go func() {
+		proxy.spawn(func() {
+			defer proxy.recoverSession(ctx, "mitm", proxyClient)
 			rawClientTls := tls.Server(proxyClient, tlsConfig)
 			if err := rawClientTls.Handshake(); err != nil {
 				ctx.Warnf("Cannot handshake client %v %v", r.Host, err)
+				proxy.Metrics.countError("tls_handshake")
+				proxyClient.Close()
 				return
 			}
 			defer rawClientTls.Close()
 			clientTlsReader := bufio.NewReader(rawClientTls)
-			for !isEof(clientTlsReader) {
+			proxy.setHeaderDeadline(rawClientTls, true)
+			var exchange *ProxyCtx
+			defer func() {
+				if exchange != nil {
+					proxy.abandon(exchange)
+				}
+			}()
+			for !proxy.waitRequest(ctx) && !isEof(clientTlsReader) {
+				proxy.gotRequest(ctx)
 				req, err := http.ReadRequest(clientTlsReader)
-				var ctx = &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, UserData: ctx.UserData}
+				var ctx = proxy.newCtx(req, ctx)
+				if err != nil && isTimeout(err) {
+					proxy.timedOut(ctx, "header_read", "Timed out waiting for request headers of mitm'd client after %v", proxy.HeaderReadTimeout)
+				}
 				if err != nil && err != io.EOF {
 					return
 				}
@@ -178,6 +365,8 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					ctx.Warnf("Cannot read TLS request from mitm'd client %v %v", r.Host, err)
 					return
 				}
+				proxy.setHeaderDeadline(rawClientTls, false)
+				ctx.status, exchange = http.StatusBadGateway, ctx
 				req.RemoteAddr = r.RemoteAddr
 				ctx.Logf("req %v", r.Host)
 
@@ -186,23 +375,41 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				}
 
 				ctx.Req = req
+				proxy.sessions.setInflight(ctx)
 
+				span := ctx.trace.start("request handlers", SpanKindInternal, nil)
 				req, resp := proxy.filterRequest(req, ctx)
+				ctx.trace.end(span, nil)
 				if resp == nil {
 					if err != nil {
 						ctx.Warnf("Illegal URL %s", "https://"+r.Host+req.URL.Path)
+						proxy.complete(ctx, httpError(rawClientTls, ctx, err), 0)
 						return
 					}
 					removeProxyHeaders(ctx, req)
-					resp, err = ctx.RoundTrip(req)
+					resp, err = proxy.roundTrip(req, ctx, sendRoundTrip)
 					if err != nil {
 						ctx.Warnf("Cannot read TLS response from mitm'd server %v", err)
-						return
+						ctx.Error = err
+						proxy.Metrics.countError("roundtrip")
+					} else {
+						ctx.Logf("resp %v", resp.Status)
 					}
-					ctx.Logf("resp %v", resp.Status)
 				}
+				span = ctx.trace.start("response handlers", SpanKindInternal, nil)
 				resp = proxy.filterResponse(resp, ctx)
+				ctx.trace.end(span, nil)
+				if resp == nil {
+					err := ctx.Error
+					if err == nil {
+						err = errNoResponse
+					}
+					proxy.complete(ctx, httpError(rawClientTls, ctx, err), 0)
+					return
+				}
+				ctx.status = resp.StatusCode
 				defer resp.Body.Close()
+				resp.Body = &countingBody{ReadCloser: resp.Body, n: &ctx.bytesOut}
 
 				text := resp.Status
 				statusCode := strconv.Itoa(resp.StatusCode) + " "
@@ -215,13 +422,14 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					return
 				}
 
-				if resp.Request.Method == "HEAD" {
+				if ctx.Req.Method == "HEAD" {
 
 				} else {
 					resp.Header.Del("Content-Length")
 					resp.Header.Set("Transfer-Encoding", "chunked")
 				}
 				resp.Header.Set("Connection", "close")
+				proxy.addServerTiming(resp.Header, ctx)
 				if err := resp.Header.Write(rawClientTls); err != nil {
 					ctx.Warnf("Cannot write TLS response header from mitm'd client: %v", err)
 					return
@@ -231,11 +439,15 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					return
 				}
 
-				if resp.Request.Method == "HEAD" {
+				var written int64
+				if ctx.Req.Method == "HEAD" {
 
 				} else {
 					chunked := newChunkedWriter(rawClientTls)
-					if _, err = io.Copy(chunked, resp.Body); err != nil {
+					span = ctx.trace.start("copy body", SpanKindInternal, nil)
+					written, err = io.Copy(chunked, resp.Body)
+					ctx.trace.end(span, err)
+					if err != nil {
 						ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
 						return
 					}
@@ -248,14 +460,20 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 						return
 					}
 				}
+				proxy.Metrics.countRequest(ctx.Req.Method, resp.StatusCode, ctx.Req.URL.Hostname())
+				proxy.complete(ctx, resp.StatusCode, written)
+				proxy.setHeaderDeadline(rawClientTls, true)
 			}
 			ctx.Logf("Exiting on EOF")
-		}()
+		})
 	case ConnectReject:
-		if ctx.Resp != nil {
-			if err := ctx.Resp.Write(proxyClient); err != nil {
-				ctx.Warnf("Cannot write response that reject http CONNECT: %v", err)
-			}
+		if ctx.Resp == nil {
+			proxy.complete(ctx, httpError(proxyClient, ctx, ErrBlocked), 0)
+			return
+		}
+		proxy.complete(ctx, ctx.Resp.StatusCode, 0)
+		if err := ctx.Resp.Write(proxyClient); err != nil {
+			ctx.Warnf("Cannot write response that reject http CONNECT: %v", err)
 		}
 		proxyClient.Close()
 	}
@@ -304,7 +522,21 @@ func dialerFromEnv(proxy *ProxyHttpServer) func(network, addr string) (net.Conn,
 	if https_proxy == "" {
 		return nil
 	}
-	return proxy.NewConnectDialToProxy(https_proxy)
+	dial := proxy.NewConnectDialToProxy(https_proxy)
+	if dial == nil {
+		return nil
+	}
+	no_proxy := os.Getenv("NO_PROXY")
+	if no_proxy == "" {
+		no_proxy = os.Getenv("no_proxy")
+	}
+	noProxy := parseNoProxy(no_proxy)
+	return func(network, addr string) (net.Conn, error) {
+		if noProxy.match(addr) {
+			return proxy.dial(network, addr)
+		}
+		return dial(network, addr)
+	}
 }
 
 func (proxy *ProxyHttpServer) NewConnectDialToProxy(https_proxy string) func(network, addr string) (net.Conn, error) {
@@ -312,100 +544,154 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxy(https_proxy string) func(net
 }
 
 func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy string, connectReqHandler func(req *http.Request)) func(network, addr string) (net.Conn, error) {
+	return proxy.newConnectDialToProxy(https_proxy, connectReqHandler, nil).withoutContext()
+}
+
+func (proxy *ProxyHttpServer) NewConnectDialToProxyWithAuth(https_proxy string, auth *ProxyAuth) func(network, addr string) (net.Conn, error) {
+	return proxy.newConnectDialToProxy(https_proxy, nil, auth).withoutContext()
+}
+
+type dialContextFunc func(c context.Context, network, addr string) (net.Conn, error)
+
+func (dial dialContextFunc) withoutContext() func(network, addr string) (net.Conn, error) {
+	if dial == nil {
+		return nil
+	}
+	return func(network, addr string) (net.Conn, error) {
+		return dial(context.Background(), network, addr)
+	}
+}
+
+func (proxy *ProxyHttpServer) newConnectDialToProxy(https_proxy string, connectReqHandler func(req *http.Request), auth *ProxyAuth) dialContextFunc {
 	u, err := url.Parse(https_proxy)
 	if err != nil {
 		return nil
 	}
-	if u.Scheme == "" || u.Scheme == "http" {
-		if strings.IndexRune(u.Host, ':') == -1 {
-			u.Host += ":80"
+	switch u.Scheme {
+	case "", "http", "https", "wss":
+	default:
+		return nil
+	}
+	if auth == nil && u.User != nil {
+		pass, _ := u.User.Password()
+		auth = &ProxyAuth{Username: u.User.Username(), Password: pass, Preemptive: true}
+	}
+	return func(c context.Context, network, addr string) (net.Conn, error) {
+		connectReq := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
 		}
-		return func(network, addr string) (net.Conn, error) {
-			connectReq := &http.Request{
-				Method: "CONNECT",
-				URL: &url.URL{
-					Opaque: addr,
-				},
-				Host:   addr,
-				Header: make(http.Header),
-			}
-			if connectReqHandler != nil {
-				connectReqHandler(connectReq)
-			}
-			c, err := proxy.dial(network, u.Host)
-			if err != nil {
-				return nil, err
-			}
-			connectReq.Write(c)
-			br := bufio.NewReader(c)
-			resp, err := http.ReadResponse(br, connectReq)
-			if err != nil {
-				c.Close()
-				return nil, err
+		if connectReqHandler != nil {
+			connectReqHandler(connectReq)
+		}
+		pc, err := proxy.dialProxyConn(c, u, network)
+		if err != nil {
+			return nil, err
+		}
+		stop := interruptOn(c, pc)
+		var resp *http.Response
+		if auth != nil {
+			write := func(w io.Writer, req *http.Request) error {
+				return req.Write(w)
 			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				resp, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					return nil, err
+			redial := func() (*proxyConn, error) {
+				stop()
+				pc, err := proxy.dialProxyConn(c, u, network)
+				if err == nil {
+					stop = interruptOn(c, pc)
+				} else {
+					stop = func() bool { return c.Err() != nil }
 				}
-				c.Close()
-				return nil, errors.New("proxy refused connection" + string(resp))
+				return pc, err
 			}
-			return c, nil
-		}
-	}
-	if u.Scheme == "https" || u.Scheme == "wss" {
-		if strings.IndexRune(u.Host, ':') == -1 {
-			u.Host += ":443"
+			pc, resp, err = auth.roundTrip(pc, connectReq, write, redial)
+		} else if err = connectReq.Write(pc); err == nil {
+			resp, err = http.ReadResponse(pc.br, connectReq)
 		}
-		return func(network, addr string) (net.Conn, error) {
-			c, err := proxy.dial(network, u.Host)
-			if err != nil {
-				return nil, err
+		if stop() {
+			if pc != nil {
+				pc.Close()
 			}
-			c = tls.Client(c, proxy.Tr.TLSClientConfig)
-			connectReq := &http.Request{
-				Method: "CONNECT",
-				URL:    &url.URL{Opaque: addr},
-				Host:   addr,
-				Header: make(http.Header),
-			}
-			if connectReqHandler != nil {
-				connectReqHandler(connectReq)
+			return nil, c.Err()
+		}
+		if err != nil {
+			if pc != nil {
+				pc.Close()
 			}
-			connectReq.Write(c)
-			br := bufio.NewReader(c)
-			resp, err := http.ReadResponse(br, connectReq)
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
+			pc.Close()
 			if err != nil {
-				c.Close()
 				return nil, err
 			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
-				if err != nil {
-					return nil, err
-				}
-				c.Close()
-				return nil, errors.New("proxy refused connection" + string(body))
-			}
-			return c, nil
+			return nil, refused(resp.StatusCode, body)
 		}
+		return pc.Conn, nil
 	}
-	return nil
 }
 
 func (proxy *ProxyHttpServer) dial(network, addr string) (c net.Conn, err error) {
+	return proxy.dialContext(context.Background(), network, addr)
+}
+
+func (proxy *ProxyHttpServer) dialContext(c context.Context, network, addr string) (net.Conn, error) {
 	if proxy.Tr.Dial != nil {
 		return proxy.Tr.Dial(network, addr)
 	}
-	return net.Dial(network, addr)
+	var d net.Dialer
+	return d.DialContext(c, network, addr)
+}
+
+// interruptOn fails blocked I/O on conn once c ends, until the returned
+// function is called. That function tells whether c ended first.
+func interruptOn(c context.Context, conn net.Conn) func() bool {
+	if c.Done() == nil {
+		return func() bool { return false }
+	}
+	stop, interrupted := make(chan struct{}), make(chan bool, 1)
+	go func() {
+		select {
+		case <-c.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+	return func() bool {
+		close(stop)
+		return <-interrupted
+	}
 }
 
 func (proxy *ProxyHttpServer) connectDial(ctx *ProxyCtx, network, addr string) (c net.Conn, err error) {
+	span := ctx.trace.start("connect "+addr, SpanKindClient, nil)
+	defer func() { ctx.trace.end(span, err) }()
+	start := time.Now()
+	defer func() {
+		// custom and upstream dialers have no hooks, count all of it
+		ctx.timings.record(func() {
+			if err == nil && ctx.timings.Connect == 0 {
+				ctx.timings.Connect = time.Since(start)
+			}
+		})
+	}()
+	u := proxy.upstreamFor(ctx.Req, ctx)
+	defer proxy.Metrics.observeUpstream("connect", upstreamName(u), time.Now())
+	ctx.upstream = addr
+	if u != nil {
+		ctx.upstream = u.String()
+		ctx.Logf("Routing CONNECT to %s through upstream %v", addr, u)
+		return proxy.upstreamDial(ctx.Context(), u, network, addr)
+	}
+
 	if proxy.ConnectDialWithReq == nil && proxy.ConnectDial == nil {
-		return proxy.dial(network, addr)
+		return proxy.dialContext(ctx.timings.context(ctx.trace.context(ctx.Context(), span)), network, addr)
 	}
 
 	if proxy.ConnectDialWithReq != nil {
@@ -424,7 +710,9 @@ func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls
 		config := defaultTLSConfig.Clone()
 		ctx.Logf("signing for %s", hostname)
 
+		generated := false
 		genCert := func() (*tls.Certificate, error) {
+			generated = true
 			return signHost(*ca, []string{hostname})
 		}
 		if ctx.certStore != nil {
@@ -432,6 +720,7 @@ func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls
 		} else {
 			cert, err = genCert()
 		}
+		ctx.Proxy.Metrics.countCert(generated, ctx.certStore != nil)
 
 		if err != nil {
 			ctx.Warnf("Cannot sign host certificate with provided CA %s", err)
@@ -1,5 +1,130 @@
 package myproxy
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
 type Logger interface {
 	Printf(format string, v ...interface{})
 }
+
+// StructuredLogger is a leveled logger taking alternating keys and values
+// after the message. *slog.Logger implements it.
+type StructuredLogger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// LogLevel uses the same values as slog.Level.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// NewPrintfLogger adapts a Printf logger to StructuredLogger, writing the
+// fields as key=value after the message.
+func NewPrintfLogger(l Logger) StructuredLogger {
+	return printfLogger{l}
+}
+
+type printfLogger struct {
+	l Logger
+}
+
+func (p printfLogger) Debug(msg string, args ...interface{}) { p.log(LevelDebug, msg, args) }
+func (p printfLogger) Info(msg string, args ...interface{})  { p.log(LevelInfo, msg, args) }
+func (p printfLogger) Warn(msg string, args ...interface{})  { p.log(LevelWarn, msg, args) }
+func (p printfLogger) Error(msg string, args ...interface{}) { p.log(LevelError, msg, args) }
+
+func (p printfLogger) log(level LogLevel, msg string, args []interface{}) {
+	var b strings.Builder
+	if len(args) >= 2 && args[0] == "session" {
+		fmt.Fprintf(&b, "[%03d]", args[1])
+		args = args[2:]
+	}
+	b.WriteString(level.String())
+	b.WriteString(": ")
+	b.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	p.l.Printf("%s\n", b.String())
+}
+
+func (proxy *ProxyHttpServer) logEnabled(level LogLevel) bool {
+	if level < proxy.LogLevel {
+		return false
+	}
+	// info stays behind Verbose unless a lower level was asked for
+	return level >= LevelWarn || proxy.Verbose || proxy.LogLevel < LevelInfo
+}
+
+func (proxy *ProxyHttpServer) log(level LogLevel, msg string, args ...interface{}) {
+	if !proxy.logEnabled(level) {
+		return
+	}
+	l := proxy.StructuredLogger
+	if l == nil {
+		l = NewPrintfLogger(proxy.Logger)
+	}
+	switch {
+	case level >= LevelError:
+		l.Error(msg, args...)
+	case level >= LevelWarn:
+		l.Warn(msg, args...)
+	case level >= LevelInfo:
+		l.Info(msg, args...)
+	default:
+		l.Debug(msg, args...)
+	}
+}
+
+func requestID(req *http.Request) string {
+	if req != nil {
+		if id := req.Header.Get("X-Request-Id"); validRequestID(id) {
+			return id
+		}
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether a client-supplied id is safe to log and
+// echo: at most 128 letters, digits and "-_.:".
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_.:", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package myproxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fj9140/myproxy"
+)
+
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) record(level, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	line := level + " " + msg
+	for i := 0; i+1 < len(args); i += 2 {
+		line += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+	l.lines = append(l.lines, line)
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.record("DEBUG", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.record("INFO", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record("WARN", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.record("ERROR", msg, args) }
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) find(substrs ...string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+outer:
+	for _, line := range l.lines {
+		for _, s := range substrs {
+			if !strings.Contains(line, s) {
+				continue outer
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func TestStructuredLogFields(t *testing.T) {
+	logger := &recordingLogger{}
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.StructuredLogger = logger
+	proxy.LogLevel = myproxy.LevelDebug
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	req, _ := http.NewRequest("GET", https.URL+"/bobo", nil)
+	req.Header.Set("X-Request-Id", "abc123")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if !logger.find("INFO ", "session=", "client=127.0.0.1:", "host="+https.Listener.Addr().String(), "action=mitm", "request_id=abc123") {
+		t.Errorf("Expected a line with all fields of the MITM'd request, got %q", logger.lines)
+	}
+}
+
+func TestRequestIDFromClient(t *testing.T) {
+	ids := make(chan string, 1)
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ids <- ctx.RequestID
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for sent, kept := range map[string]bool{
+		"4bf92f35-77b3.4c:a_1":   true,
+		"a b<script>":            false,
+		strings.Repeat("a", 129): false,
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+"/bobo", nil)
+		req.Header.Set("X-Request-Id", sent)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if id := <-ids; (id == sent) != kept || id == "" {
+			t.Errorf("Expected %q to be kept %v, got request ID %q", sent, kept, id)
+		}
+	}
+}
+
+func TestPrintfLoggerAdapter(t *testing.T) {
+	logger := &recordingLogger{}
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.Logger = logger
+	proxy.Verbose = true
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(srv.URL+"/bobo", client, t)
+	if !logger.find("]INFO: ", "client=", "request_id=") {
+		t.Errorf("Expected Printf logger to get the fields, got %q", logger.lines)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	for _, tc := range []struct {
+		verbose  bool
+		level    myproxy.LogLevel
+		expected bool
+	}{
+		{false, myproxy.LevelInfo, false},
+		{true, myproxy.LevelInfo, true},
+		{false, myproxy.LevelDebug, true},
+		{true, myproxy.LevelWarn, false},
+	} {
+		logger := &recordingLogger{}
+		proxy := myproxy.NewProxyHttpServer()
+		proxy.StructuredLogger = logger
+		proxy.Verbose = tc.verbose
+		proxy.LogLevel = tc.level
+		client, l := oneShotProxy(proxy, t)
+		getOrFail(srv.URL+"/bobo", client, t)
+		l.Close()
+		if got := logger.find("INFO "); got != tc.expected {
+			t.Errorf("Verbose %v and level %v: expected info lines %v, got %v", tc.verbose, tc.level, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package myproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics counts what goes through a proxy. Set it as
+// ProxyHttpServer.Metrics, and serve it to expose the counters in the
+// Prometheus text format, either on its own listener or with Handler
+// through NonproxyHandler. A nil *Metrics collects nothing.
+type Metrics struct {
+	activeTunnels int64
+	activeMitm    int64
+	bytesIn       int64
+	bytesOut      int64
+
+	mu              sync.Mutex
+	requests        map[string]uint64
+	connects        map[string]uint64
+	errors          map[string]uint64
+	timeouts        map[string]uint64
+	panics          map[string]uint64
+	certGenerations uint64
+	certStore       map[string]uint64
+	latency         map[string]*histogram
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[string]uint64),
+		connects:  make(map[string]uint64),
+		errors:    make(map[string]uint64),
+		timeouts:  make(map[string]uint64),
+		panics:    make(map[string]uint64),
+		certStore: make(map[string]uint64),
+		latency:   make(map[string]*histogram),
+	}
+}
+
+// Handler serves the metrics on path and hands any other request to next.
+func (m *Metrics) Handler(path string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			if next == nil {
+				http.NotFound(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.ServeHTTP(w, r)
+	})
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func labelKey(values ...string) string {
+	return strings.Join(values, "\xff")
+}
+
+func (m *Metrics) countRequest(method string, status int, host string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.requests[labelKey(method, strconv.Itoa(status), host)]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) countConnect(action ConnectActionLiteral) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.connects[action.String()]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) countError(stage string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.errors[stage]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) countTimeout(kind string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.timeouts[kind]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) countPanic(handler string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.panics[handler]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) countCert(generated, stored bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if generated {
+		m.certGenerations++
+	}
+	if stored {
+		if generated {
+			m.certStore["miss"]++
+		} else {
+			m.certStore["hit"]++
+		}
+	}
+	m.mu.Unlock()
+}
+
+func (m *Metrics) observeUpstream(kind, upstream string, start time.Time) {
+	if m == nil {
+		return
+	}
+	d := time.Since(start).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := labelKey(kind, upstream)
+	h := m.latency[key]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.latency[key] = h
+	}
+	for i, b := range latencyBuckets {
+		if d <= b {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += d
+}
+
+func (m *Metrics) addBytes(in, out int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.bytesIn, in)
+	atomic.AddInt64(&m.bytesOut, out)
+}
+
+func (m *Metrics) tunnelOpened(action ConnectActionLiteral) func() {
+	if m == nil {
+		return func() {}
+	}
+	gauge := &m.activeTunnels
+	if action == ConnectMitm || action == ConnectHTTPMitm {
+		gauge = &m.activeMitm
+	}
+	atomic.AddInt64(gauge, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { atomic.AddInt64(gauge, -1) })
+	}
+}
+
+func upstreamName(u *Upstream) string {
+	if u == nil {
+		return "direct"
+	}
+	return u.String()
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := &promWriter{w: w}
+	p.vec("myproxy_requests_total", "counter", "Requests answered, MITM'd ones included.",
+		[]string{"method", "status", "host"}, m.requests)
+	p.vec("myproxy_connects_total", "counter", "CONNECT requests by action taken.",
+		[]string{"action"}, m.connects)
+	p.single("myproxy_active_tunnels", "gauge", "CONNECT tunnels open.", float64(atomic.LoadInt64(&m.activeTunnels)))
+	p.single("myproxy_active_mitm_sessions", "gauge", "MITM'd CONNECT sessions open.", float64(atomic.LoadInt64(&m.activeMitm)))
+	p.single("myproxy_bytes_in_total", "counter", "Bytes received from clients.", float64(atomic.LoadInt64(&m.bytesIn)))
+	p.single("myproxy_bytes_out_total", "counter", "Bytes sent to clients.", float64(atomic.LoadInt64(&m.bytesOut)))
+	p.histograms("myproxy_upstream_latency_seconds", "Time to the response headers of requests and to the dial of CONNECTs.",
+		[]string{"type", "upstream"}, m.latency)
+	p.single("myproxy_cert_generations_total", "counter", "Certificates signed for MITM.", float64(m.certGenerations))
+	p.vec("myproxy_cert_store_requests_total", "counter", "CertStorage fetches by result.",
+		[]string{"result"}, m.certStore)
+	p.vec("myproxy_errors_total", "counter", "Errors while handling traffic by stage.",
+		[]string{"stage"}, m.errors)
+	p.vec("myproxy_timeouts_total", "counter", "Tunnels and requests cut by a timeout by kind.",
+		[]string{"kind"}, m.timeouts)
+	p.vec("myproxy_handler_panics_total", "counter", "Panics recovered from handlers by kind of handler.",
+		[]string{"handler"}, m.panics)
+	return p.n, p.err
+}
+
+type promWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.n += int64(n)
+	p.err = err
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) single(name, typ, help string, v float64) {
+	p.header(name, typ, help)
+	p.printf("%s %s\n", name, formatFloat(v))
+}
+
+func (p *promWriter) vec(name, typ, help string, labels []string, values map[string]uint64) {
+	p.header(name, typ, help)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		p.printf("%s{%s} %d\n", name, formatLabels(labels, key), values[key])
+	}
+}
+
+func (p *promWriter) histograms(name, help string, labels []string, hs map[string]*histogram) {
+	p.header(name, "histogram", help)
+	keys := make([]string, 0, len(hs))
+	for k := range hs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h, l := hs[key], formatLabels(labels, key)
+		for i, b := range latencyBuckets {
+			p.printf("%s_bucket{%s,le=\"%s\"} %d\n", name, l, formatFloat(b), h.buckets[i])
+		}
+		p.printf("%s_bucket{%s,le=\"+Inf\"} %d\n", name, l, h.count)
+		p.printf("%s_sum{%s} %s\n", name, l, formatFloat(h.sum))
+		p.printf("%s_count{%s} %d\n", name, l, h.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, key string) string {
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// trackedConn counts the bytes of a client connection in its ctx and calls
+// done once it is closed, keeping it half-closable when it was.
+type trackedConn struct {
+	net.Conn
+	m    *Metrics
+	ctx  *ProxyCtx
+	once sync.Once
+	done func()
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.StoreInt64(&c.ctx.lastActivity, time.Now().UnixNano())
+	atomic.AddInt64(&c.ctx.bytesIn, int64(n))
+	c.m.addBytes(int64(n), 0)
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.StoreInt64(&c.ctx.lastActivity, time.Now().UnixNano())
+	atomic.AddInt64(&c.ctx.bytesOut, int64(n))
+	c.m.addBytes(0, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) finish() {
+	c.once.Do(c.done)
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.finish()
+	return err
+}
+
+type trackedHalfConn struct {
+	*trackedConn
+	mu                      sync.Mutex
+	readClosed, writeClosed bool
+}
+
+func (c *trackedHalfConn) CloseWrite() error {
+	err := c.Conn.(halfClosable).CloseWrite()
+	c.mu.Lock()
+	c.writeClosed = true
+	closed := c.readClosed
+	c.mu.Unlock()
+	if closed {
+		c.finish()
+	}
+	return err
+}
+
+func (c *trackedHalfConn) CloseRead() error {
+	err := c.Conn.(halfClosable).CloseRead()
+	c.mu.Lock()
+	c.readClosed = true
+	closed := c.writeClosed
+	c.mu.Unlock()
+	if closed {
+		c.finish()
+	}
+	return err
+}
+
+func (proxy *ProxyHttpServer) trackConn(c net.Conn, ctx *ProxyCtx, done func()) net.Conn {
+	tc := &trackedConn{Conn: c, m: proxy.Metrics, ctx: ctx, done: done}
+	if _, ok := c.(halfClosable); ok {
+		return &trackedHalfConn{trackedConn: tc}
+	}
+	return tc
+}
+
+// countingBody counts the bytes of a body read by the proxy.
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+	m *Metrics
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	b.m.addBytes(int64(n), 0)
+	return n, err
+}
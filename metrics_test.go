@@ -0,0 +1,65 @@
+package myproxy_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fj9140/myproxy"
+)
+
+func scrape(t *testing.T, m *myproxy.Metrics) string {
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	b, _ := ioutil.ReadAll(rec.Body)
+	return string(b)
+}
+
+func TestMetrics(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.Metrics = myproxy.NewMetrics()
+	proxy.CertStore = newTestCertStorage()
+	proxy.OnRequest(myproxy.ReqHostIs(https.Listener.Addr().String())).HandleConnect(myproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(srv.URL+"/bobo", client, t)
+	getOrFail(https.URL+"/bobo", client, t)
+
+	out := scrape(t, proxy.Metrics)
+	for _, expected := range []string{
+		`myproxy_requests_total{method="GET",status="200",host="127.0.0.1"} 2`,
+		`myproxy_connects_total{action="mitm"} 1`,
+		`myproxy_cert_generations_total 1`,
+		`myproxy_cert_store_requests_total{result="miss"} 1`,
+		`myproxy_upstream_latency_seconds_count{type="request",upstream="direct"} 2`,
+		`# TYPE myproxy_upstream_latency_seconds histogram`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in metrics:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "myproxy_bytes_out_total 0\n") {
+		t.Error("Expected bytes sent to clients to be counted")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := myproxy.NewMetrics()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.NonproxyHandler = m.Handler("/metrics", proxy.NonproxyHandler)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), "# TYPE myproxy_requests_total counter") {
+		t.Error("Expected metrics on /metrics, got", string(b))
+	}
+}
@@ -0,0 +1,118 @@
+package myproxy
+
+import "net/http"
+
+// Middleware wraps the round trip of requests: a layer gets the request as
+// left by the layers before it, and can answer it itself or call next and
+// rework the response it returns. Handlers registered with OnRequest and
+// OnResponse are not layers, they run around the whole pipeline.
+type Middleware func(next RoundTripperFunc) RoundTripperFunc
+
+// Use adds layers around the round trip of the requests sent upstream,
+// plain, MITM'd or from ConnectHTTPMitm tunnels. Layers run in the order
+// they were added, after the request handlers and before the response
+// handlers, which see whatever response or error the layers return; a
+// request handler answering the request skips them. To run a handler
+// between layers, add it with ReqHandlerMiddleware or RespHandlerMiddleware
+// rather than registering it. In
+// ConnectHTTPMitm tunnels, where requests share a connection to the target,
+// calling next again for a request sends it on a new connection. Layers can
+// be added while the proxy serves, running requests keep the layers they
+// started with.
+//
+//	proxy.Use(func(next myproxy.RoundTripperFunc) myproxy.RoundTripperFunc {
+//		return func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Response, error) {
+//			start := time.Now()
+//			defer func() { ctx.Logf("upstream took %v", time.Since(start)) }()
+//			return next(req, ctx)
+//		}
+//	})
+func (proxy *ProxyHttpServer) Use(m ...Middleware) {
+	r := &proxy.rules
+	r.change(func() { r.middlewares = append(r.middlewares, m...) })
+}
+
+// ReqHandlerMiddleware turns h into a layer, a response from h answers the
+// request without calling the next layers.
+func ReqHandlerMiddleware(h ReqHandler) Middleware {
+	return func(next RoundTripperFunc) RoundTripperFunc {
+		return func(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+			req, resp := h.Handle(req, ctx)
+			if resp != nil {
+				return resp, nil
+			}
+			return next(req, ctx)
+		}
+	}
+}
+
+// RespHandlerMiddleware turns h into a layer handling the response of the
+// next layers. On error h is called with a nil response and ctx.Error set,
+// as response handlers are.
+func RespHandlerMiddleware(h RespHandler) Middleware {
+	return func(next RoundTripperFunc) RoundTripperFunc {
+		return func(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+			resp, err := next(req, ctx)
+			if err != nil {
+				ctx.Error = err
+			}
+			ctx.Resp = resp
+			if resp = h.Handle(resp, ctx); resp == nil {
+				if err == nil {
+					err = errNoResponse
+				}
+				return nil, err
+			}
+			return resp, nil
+		}
+	}
+}
+
+// roundTrip sends req through the layers of the proxy to send, the round
+// trip of its kind of request.
+func (proxy *ProxyHttpServer) roundTrip(req *http.Request, ctx *ProxyCtx, send RoundTripperFunc) (resp *http.Response, err error) {
+	middlewares := ctx.handlers().middlewares
+	if len(middlewares) == 0 {
+		return send(req, ctx)
+	}
+	// panics of send are not the layers', they go on past them
+	rt := RoundTripperFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+		defer func() {
+			if v := recover(); v != nil {
+				panic(&sendPanic{v})
+			}
+		}()
+		return send(req, ctx)
+	})
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		rt = middlewares[i](rt)
+	}
+	var escaped *sendPanic
+	if p := proxy.protect(ctx, "middleware", func() {
+		defer func() {
+			if v := recover(); v != nil {
+				if sp, ok := v.(*sendPanic); ok {
+					escaped = sp
+					return
+				}
+				panic(v)
+			}
+		}()
+		resp, err = rt(req, ctx)
+	}); p != nil {
+		return nil, p
+	}
+	if escaped != nil {
+		panic(escaped.v)
+	}
+	if resp == nil && err == nil {
+		err = errNoResponse
+	}
+	return resp, err
+}
+
+type sendPanic struct{ v interface{} }
+
+func sendRoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+	return ctx.RoundTrip(req)
+}
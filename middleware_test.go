@@ -0,0 +1,164 @@
+package myproxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fj9140/myproxy"
+)
+
+func layer(name string) myproxy.Middleware {
+	return func(next myproxy.RoundTripperFunc) myproxy.RoundTripperFunc {
+		return func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Response, error) {
+			req.Header.Add("X-Layers", name)
+			resp, err := next(req, ctx)
+			if resp != nil {
+				resp.Header.Add("X-Layers", name)
+			}
+			return resp, err
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Join(r.Header["X-Layers"], ",")))
+	}))
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		req = req.Clone(req.Context())
+		req.Header.Add("X-Layers", "handler")
+		return req, nil
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		req.Header.Add("X-Layers", "handler2")
+		return req, nil
+	})
+	proxy.Use(layer("outer"), layer("inner"))
+	var seen string
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+		seen = strings.Join(resp.Header["X-Layers"], ",")
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(origin.URL, client, t)); r != "handler,handler2,outer,inner" {
+		t.Error("Expected layers to see the request of the handlers and layers before them, got", r)
+	}
+	if seen != "inner,outer" {
+		t.Error("Expected response handlers to see the response of the layers, got", seen)
+	}
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	var hits int32
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("fresh"))
+	}))
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	cached := map[string]bool{}
+	proxy.Use(func(next myproxy.RoundTripperFunc) myproxy.RoundTripperFunc {
+		return func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Response, error) {
+			if cached[req.URL.String()] {
+				return myproxy.NewResponse(req, myproxy.ContentTypeText, http.StatusOK, "cached"), nil
+			}
+			resp, err := next(req, ctx)
+			if err == nil {
+				cached[req.URL.String()] = true
+			}
+			return resp, err
+		}
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, expected := range []string{"fresh", "cached", "cached"} {
+		if r := string(getOrFail(origin.URL+"/bobo", client, t)); r != expected {
+			t.Errorf("Expected %q, got %q", expected, r)
+		}
+	}
+	if hits != 1 {
+		t.Error("Expected a single upstream request, got", hits)
+	}
+}
+
+func TestMiddlewareRetry(t *testing.T) {
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("busy"))
+			return
+		}
+		w.Write([]byte("second try"))
+	}))
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *myproxy.ProxyCtx) (*myproxy.ConnectAction, string) {
+		return myproxy.HTTPMitmConnect, host
+	})
+	proxy.Use(func(next myproxy.RoundTripperFunc) myproxy.RoundTripperFunc {
+		return func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Response, error) {
+			resp, err := next(req, ctx)
+			if err == nil && resp.StatusCode == http.StatusServiceUnavailable {
+				// the unread body must not be taken for the next response
+				defer resp.Body.Close()
+				return next(req, ctx)
+			}
+			return resp, err
+		}
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	host := origin.Listener.Addr().String()
+	c, _ := connectThrough(t, l, host)
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for i := 0; i < 2; i++ {
+		fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		if string(b) != "second try" {
+			t.Errorf("Expected the retried response, got %s %q", resp.Status, b)
+		}
+	}
+}
+
+func TestHandlerMiddlewares(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.Use(
+		myproxy.RespHandlerMiddleware(myproxy.FuncRespHandler(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+			resp.Header.Set("X-Handled", "yes")
+			return resp
+		})),
+		myproxy.ReqHandlerMiddleware(myproxy.FuncReqHandler(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return req, myproxy.NewResponse(req, myproxy.ContentTypeText, http.StatusOK, "answered")
+		})),
+	)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Handled") != "yes" {
+		t.Error("Expected the response handler layer to see the answer of the request handler layer")
+	}
+}
@@ -0,0 +1,188 @@
+package myproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	ntlmNegotiateUnicode     = 0x00000001
+	ntlmNegotiateOEM         = 0x00000002
+	ntlmRequestTarget        = 0x00000004
+	ntlmNegotiateNTLM        = 0x00000200
+	ntlmNegotiateAlwaysSign  = 0x00008000
+	ntlmNegotiateExtendedSec = 0x00080000
+	ntlmNegotiateTargetInfo  = 0x00800000
+	ntlmNegotiate128         = 0x20000000
+	ntlmNegotiate56          = 0x80000000
+
+	ntlmNegotiateFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget |
+		ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSec |
+		ntlmNegotiate128 | ntlmNegotiate56
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+func ntlmNegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateFlags)
+	return msg
+}
+
+type ntlmChallenge struct {
+	flags           uint32
+	serverChallenge []byte
+	targetInfo      []byte
+}
+
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 32 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errors.New("ntlm: invalid challenge message")
+	}
+	c := &ntlmChallenge{
+		flags:           binary.LittleEndian.Uint32(msg[20:]),
+		serverChallenge: msg[24:32],
+	}
+	if len(msg) >= 48 {
+		l := int(binary.LittleEndian.Uint16(msg[40:]))
+		off := int(binary.LittleEndian.Uint32(msg[44:]))
+		if off+l > len(msg) {
+			return nil, errors.New("ntlm: invalid target info in challenge message")
+		}
+		c.targetInfo = msg[off : off+l]
+	}
+	return c, nil
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, r := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func ntowfV2(password, user, domain string) []byte {
+	hash := md4Sum(utf16le(password))
+	return hmacMD5(hash[:], utf16le(strings.ToUpper(user)+domain))
+}
+
+func ntlmV2Response(ntowf, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (nt, lm []byte) {
+	temp := make([]byte, 0, 28+len(targetInfo)+4)
+	temp = append(temp, 1, 1, 0, 0, 0, 0, 0, 0)
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	proof := hmacMD5(ntowf, serverChallenge, temp)
+	nt = append(proof, temp...)
+	lm = append(hmacMD5(ntowf, serverChallenge, clientChallenge), clientChallenge...)
+	return nt, lm
+}
+
+func ntlmTimestamp(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(t.UnixNano()/100+116444736000000000))
+	return b
+}
+
+func ntlmAuthenticateMessage(c *ntlmChallenge, user, password, domain, workstation string) ([]byte, error) {
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+	nt, lm := ntlmV2Response(ntowfV2(password, user, domain), c.serverChallenge, clientChallenge,
+		ntlmTimestamp(time.Now()), c.targetInfo)
+
+	encode := utf16le
+	flags := ntlmNegotiateFlags &^ ntlmNegotiateOEM
+	if c.flags&ntlmNegotiateUnicode == 0 {
+		encode = func(s string) []byte { return []byte(s) }
+		flags = ntlmNegotiateFlags &^ ntlmNegotiateUnicode
+	}
+
+	fields := [][]byte{lm, nt, encode(domain), encode(user), encode(workstation), nil}
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	off := len(msg)
+	for i, f := range fields {
+		binary.LittleEndian.PutUint16(msg[12+8*i:], uint16(len(f)))
+		binary.LittleEndian.PutUint16(msg[14+8*i:], uint16(len(f)))
+		binary.LittleEndian.PutUint32(msg[16+8*i:], uint32(off))
+		off += len(f)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], uint32(flags))
+	for _, f := range fields {
+		msg = append(msg, f...)
+	}
+	return msg, nil
+}
+
+func md4Sum(data []byte) [16]byte {
+	s := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	msg := append([]byte(nil), data...)
+	msg = append(msg, 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(len(data))*8)
+	msg = append(msg, length[:]...)
+
+	round2 := [16]int{0, 4, 8, 12, 1, 5, 9, 13, 2, 6, 10, 14, 3, 7, 11, 15}
+	round3 := [16]int{0, 8, 4, 12, 2, 10, 6, 14, 1, 9, 5, 13, 3, 11, 7, 15}
+	for p := msg; len(p) > 0; p = p[64:] {
+		var x [16]uint32
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(p[4*i:])
+		}
+		a, b, c, d := s[0], s[1], s[2], s[3]
+		for i := 0; i < 16; i++ {
+			f := (b & c) | (^b & d)
+			a = bits.RotateLeft32(a+f+x[i], []int{3, 7, 11, 19}[i%4])
+			a, b, c, d = d, a, b, c
+		}
+		for i := 0; i < 16; i++ {
+			g := (b & c) | (b & d) | (c & d)
+			a = bits.RotateLeft32(a+g+x[round2[i]]+0x5a827999, []int{3, 5, 9, 13}[i%4])
+			a, b, c, d = d, a, b, c
+		}
+		for i := 0; i < 16; i++ {
+			h := b ^ c ^ d
+			a = bits.RotateLeft32(a+h+x[round3[i]]+0x6ed9eba1, []int{3, 9, 11, 15}[i%4])
+			a, b, c, d = d, a, b, c
+		}
+		s[0] += a
+		s[1] += b
+		s[2] += c
+		s[3] += d
+	}
+
+	var sum [16]byte
+	for i, v := range s {
+		binary.LittleEndian.PutUint32(sum[4*i:], v)
+	}
+	return sum
+}
@@ -0,0 +1,63 @@
+package myproxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestMD4(t *testing.T) {
+	for in, expected := range map[string]string{
+		"":    "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"abc": "a448017aaf21d8525fc10ae87aa6729d",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	} {
+		if sum := md4Sum([]byte(in)); hex.EncodeToString(sum[:]) != expected {
+			t.Errorf("md4(%q) = %x, expected %s", in, sum, expected)
+		}
+	}
+}
+
+func TestNTLMv2Response(t *testing.T) {
+	// Test vectors from MS-NLMP section 4.2.4
+	ntowf := ntowfV2("Password", "User", "Domain")
+	if hex.EncodeToString(ntowf) != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Fatalf("Unexpected NTOWFv2 %x", ntowf)
+	}
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge, _ := hex.DecodeString("aaaaaaaaaaaaaaaa")
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+	nt, lm := ntlmV2Response(ntowf, serverChallenge, clientChallenge, make([]byte, 8), targetInfo)
+	if hex.EncodeToString(nt[:16]) != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Errorf("Unexpected NTProofStr %x", nt[:16])
+	}
+	if hex.EncodeToString(lm) != "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" {
+		t.Errorf("Unexpected LMv2 response %x", lm)
+	}
+}
+
+func TestNTLMAuthenticateMessage(t *testing.T) {
+	challenge := append([]byte("NTLMSSP\x00"), make([]byte, 40)...)
+	challenge[8] = 2
+	challenge[20] = ntlmNegotiateUnicode
+	copy(challenge[24:], "01234567")
+	c, err := parseNTLMChallenge(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ntlmAuthenticateMessage(c, "User", "Password", "Domain", "WS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := func(i int) []byte {
+		l := int(msg[12+8*i]) | int(msg[13+8*i])<<8
+		off := int(msg[16+8*i]) | int(msg[17+8*i])<<8
+		return msg[off : off+l]
+	}
+	if !bytes.Equal(field(2), utf16le("Domain")) || !bytes.Equal(field(3), utf16le("User")) || !bytes.Equal(field(4), utf16le("WS")) {
+		t.Error("Unexpected domain, user or workstation in authenticate message", msg)
+	}
+	if len(field(1)) != 16+28+4 {
+		t.Error("Unexpected NTLMv2 response length", len(field(1)))
+	}
+}
@@ -0,0 +1,51 @@
+package myproxy
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+)
+
+// HandlerPanic is the error of exchanges a handler panicked on. Handler is
+// the kind of handler: request, response, connect, tunnel, hijack or mitm
+// for anything else running in a MITM session.
+type HandlerPanic struct {
+	Handler string
+	Value   interface{}
+	Stack   []byte
+}
+
+func (p *HandlerPanic) Error() string {
+	return fmt.Sprintf("%s handler panicked: %v", p.Handler, p.Value)
+}
+
+// protect runs f, and turns a panic of it into a HandlerPanic reported to
+// the logger, the metrics and PanicHandler.
+func (proxy *ProxyHttpServer) protect(ctx *ProxyCtx, handler string, f func()) (p *HandlerPanic) {
+	defer func() {
+		if v := recover(); v != nil {
+			p = &HandlerPanic{Handler: handler, Value: v, Stack: debug.Stack()}
+			proxy.panicked(ctx, p)
+		}
+	}()
+	f()
+	return nil
+}
+
+func (proxy *ProxyHttpServer) panicked(ctx *ProxyCtx, p *HandlerPanic) {
+	ctx.Error = p
+	proxy.Metrics.countPanic(p.Handler)
+	ctx.Warnf("%v\n%s", p, p.Stack)
+	if proxy.PanicHandler != nil {
+		proxy.PanicHandler(ctx, p)
+	}
+}
+
+// recoverSession is deferred by the goroutines serving a session, it closes
+// c after a panic instead of crashing the proxy.
+func (proxy *ProxyHttpServer) recoverSession(ctx *ProxyCtx, handler string, c io.Closer) {
+	if v := recover(); v != nil {
+		proxy.panicked(ctx, &HandlerPanic{Handler: handler, Value: v, Stack: debug.Stack()})
+		c.Close()
+	}
+}
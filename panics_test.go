@@ -0,0 +1,202 @@
+package myproxy_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+type panicRecorder struct {
+	mu     sync.Mutex
+	panics []*myproxy.HandlerPanic
+}
+
+func (r *panicRecorder) record(ctx *myproxy.ProxyCtx, p *myproxy.HandlerPanic) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.panics = append(r.panics, p)
+}
+
+func (r *panicRecorder) handlers() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var handlers []string
+	for _, p := range r.panics {
+		handlers = append(handlers, p.Handler)
+	}
+	return handlers
+}
+
+func panickyProxy(rec *panicRecorder) *myproxy.ProxyHttpServer {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.Metrics = myproxy.NewMetrics()
+	proxy.PanicHandler = rec.record
+	return proxy
+}
+
+func TestPanicInRequestHandler(t *testing.T) {
+	rec := &panicRecorder{}
+	proxy := panickyProxy(rec)
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if req.URL.Path == "/boom" {
+			panic("bad rule")
+		}
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, base := range []string{srv.URL, https.URL} {
+		resp, err := client.Get(base + "/boom")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 500 || resp.Header.Get("X-Proxy-Error") != "handler_panic" {
+			t.Errorf("Expected a panic error page for %s, got %s %v", base, resp.Status, resp.Header)
+		}
+		if r := string(getOrFail(base+"/bobo", client, t)); r != "bobo" {
+			t.Errorf("Expected proxy to keep serving %s, got %q", base, r)
+		}
+	}
+	if h := rec.handlers(); len(h) != 2 || h[0] != "request" || h[1] != "request" {
+		t.Errorf("Expected two request handler panics, got %v", h)
+	}
+	if p := rec.panics[0]; p.Value != "bad rule" || !bytes.Contains(p.Stack, []byte("panics_test.go")) {
+		t.Errorf("Expected the panic value and stack, got %v\n%s", p.Value, p.Stack)
+	}
+	if out := scrape(t, proxy.Metrics); !strings.Contains(out, `myproxy_handler_panics_total{handler="request"} 2`) {
+		t.Errorf("Expected panics to be counted:\n%s", out)
+	}
+}
+
+func TestPanicInResponseHandler(t *testing.T) {
+	rec := &panicRecorder{}
+	proxy := panickyProxy(rec)
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+		var m map[string]string
+		m["boom"] = "assignment to nil map"
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(https.URL + "/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 500 || !strings.Contains(string(b), resp.Header.Get("X-Request-Id")) {
+		t.Errorf("Expected an error page for the panic, got %s %s", resp.Status, b)
+	}
+	if h := rec.handlers(); len(h) != 1 || h[0] != "response" {
+		t.Errorf("Expected a response handler panic, got %v", h)
+	}
+}
+
+func TestPanicInConnectHandler(t *testing.T) {
+	rec := &panicRecorder{}
+	proxy := panickyProxy(rec)
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *myproxy.ProxyCtx) (*myproxy.ConnectAction, string) {
+		panic("bad connect rule")
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, resp := connectThrough(t, l, https.Listener.Addr().String())
+	defer c.Close()
+	if resp.StatusCode != 500 {
+		t.Error("Expected CONNECT to fail, got", resp.Status)
+	}
+	if h := rec.handlers(); len(h) != 1 || h[0] != "connect" {
+		t.Errorf("Expected a connect handler panic, got %v", h)
+	}
+}
+
+func TestPanicInHijack(t *testing.T) {
+	rec := &panicRecorder{}
+	proxy := panickyProxy(rec)
+	proxy.OnRequest().HandleConnect(myproxy.FuncHttpsHandler(func(host string, ctx *myproxy.ProxyCtx) (*myproxy.ConnectAction, string) {
+		return &myproxy.ConnectAction{Action: myproxy.ConnectHijack, Hijack: func(req *http.Request, client net.Conn, ctx *myproxy.ProxyCtx) {
+			panic("bad hijack")
+		}}, host
+	}))
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	expectClosed(t, c, time.Second)
+	if h := rec.handlers(); len(h) != 1 || h[0] != "hijack" {
+		t.Errorf("Expected a hijack panic, got %v", h)
+	}
+}
+
+func TestPanicInTunnelHandler(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	rec := &panicRecorder{}
+	proxy := panickyProxy(rec)
+	proxy.OnRequest().DoTunnelFunc(func(client net.Conn, ctx *myproxy.ProxyCtx) net.Conn {
+		panic("bad tunnel rule")
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, resp := connectThrough(t, l, echo.Addr().String())
+	defer c.Close()
+	if resp.StatusCode != 500 {
+		t.Error("Expected CONNECT to fail, got", resp.Status)
+	}
+	if h := rec.handlers(); len(h) != 1 || h[0] != "tunnel" {
+		t.Errorf("Expected a tunnel handler panic, got %v", h)
+	}
+}
+
+func TestPanicInRoundTripper(t *testing.T) {
+	rec := &panicRecorder{}
+	proxy := panickyProxy(rec)
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.RoundTripper = myproxy.RoundTripperFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Response, error) {
+			panic("bad transport")
+		})
+		return req, nil
+	})
+	proxy.Use(func(next myproxy.RoundTripperFunc) myproxy.RoundTripperFunc {
+		return func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Response, error) {
+			if req.URL.Path == "/layer" {
+				panic("bad layer")
+			}
+			return next(req, ctx)
+		}
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(srv.URL + "/layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, err := client.Get(https.URL + "/bobo"); err == nil {
+		t.Error("Expected the MITM session to be closed by the round tripper panic")
+	}
+	if h := rec.handlers(); len(h) != 2 || h[0] != "middleware" || h[1] != "mitm" {
+		t.Errorf("Expected a middleware then a mitm panic, got %v", h)
+	}
+}
@@ -0,0 +1,352 @@
+package myproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UpstreamPool spreads CONNECT tunnels over several weighted upstream
+// proxies. Members failing MaxFails dials in a row are taken out of rotation
+// for FailTimeout, or until an active health check finds them alive again;
+// failed health checks count the same way. A failed dial, including a
+// CONNECT the member refused as unavailable, is retried on the next
+// available member. Health checks dial through the same path as tunnels.
+type UpstreamPool struct {
+	MaxFails            int
+	FailTimeout         time.Duration
+	MaxRetries          int
+	Sticky              bool
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	HealthCheckTarget   string
+
+	proxy   *ProxyHttpServer
+	mu      sync.Mutex
+	members []*poolMember
+	stop    chan struct{}
+}
+
+type poolMember struct {
+	upstream      *Upstream
+	weight        int
+	currentWeight int
+	down          bool
+	retryAt       time.Time
+	fails         int
+	totalFails    int64
+	dials         int64
+	lastError     string
+	lastCheck     time.Time
+}
+
+type UpstreamStats struct {
+	URL        string    `json:"url"`
+	Weight     int       `json:"weight"`
+	Healthy    bool      `json:"healthy"`
+	Fails      int       `json:"fails"`
+	TotalFails int64     `json:"total_fails"`
+	Dials      int64     `json:"dials"`
+	LastError  string    `json:"last_error,omitempty"`
+	LastCheck  time.Time `json:"last_check,omitempty"`
+}
+
+func (proxy *ProxyHttpServer) NewUpstreamPool() *UpstreamPool {
+	return &UpstreamPool{
+		MaxFails:           1,
+		FailTimeout:        30 * time.Second,
+		HealthCheckTimeout: 5 * time.Second,
+		proxy:              proxy,
+	}
+}
+
+func (pool *UpstreamPool) Add(proxyURL string, weight int) error {
+	u, err := NewUpstream(proxyURL)
+	if err != nil {
+		return err
+	}
+	if u.URL == nil {
+		return errors.New("upstream pool member needs a proxy URL")
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	pool.mu.Lock()
+	pool.members = append(pool.members, &poolMember{upstream: u, weight: weight})
+	pool.mu.Unlock()
+	return nil
+}
+
+func (pool *UpstreamPool) available(m *poolMember, now time.Time) bool {
+	return !m.down || !now.Before(m.retryAt)
+}
+
+func (pool *UpstreamPool) pick(key string, tried map[*poolMember]bool) *poolMember {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	now := time.Now()
+	var candidates []*poolMember
+	for _, m := range pool.members {
+		if !tried[m] && pool.available(m, now) {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, m := range pool.members {
+			if !tried[m] {
+				candidates = append(candidates, m)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if pool.Sticky && key != "" && len(tried) == 0 {
+		var best *poolMember
+		bestScore := math.Inf(-1)
+		for _, m := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(key + "|" + m.upstream.URL.String()))
+			r := (float64(h.Sum64()>>11) + 0.5) / float64(1<<53)
+			score := float64(m.weight) / -math.Log(r)
+			if score > bestScore {
+				best, bestScore = m, score
+			}
+		}
+		return best
+	}
+	var best *poolMember
+	total := 0
+	for _, m := range candidates {
+		m.currentWeight += m.weight
+		total += m.weight
+		if best == nil || m.currentWeight > best.currentWeight {
+			best = m
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+func (pool *UpstreamPool) report(m *poolMember, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	m.dials++
+	if err == nil {
+		m.fails = 0
+		m.down = false
+		return
+	}
+	pool.failed(m, err)
+}
+
+// failed counts a failure of m, pool.mu held.
+func (pool *UpstreamPool) failed(m *poolMember, err error) {
+	m.fails++
+	m.totalFails++
+	m.lastError = err.Error()
+	if m.fails >= pool.MaxFails {
+		m.down = true
+		m.retryAt = time.Now().Add(pool.FailTimeout)
+	}
+}
+
+func (pool *UpstreamPool) Dial(network, addr string) (net.Conn, error) {
+	return pool.DialWithReq(nil, network, addr)
+}
+
+func (pool *UpstreamPool) DialWithReq(req *http.Request, network, addr string) (net.Conn, error) {
+	c, key := context.Background(), ""
+	if req != nil {
+		c, key = req.Context(), clientIP(req)
+	}
+	retries := pool.MaxRetries
+	pool.mu.Lock()
+	if retries <= 0 || retries > len(pool.members) {
+		retries = len(pool.members)
+	}
+	pool.mu.Unlock()
+
+	tried := make(map[*poolMember]bool)
+	err := errors.New("upstream pool is empty")
+	for i := 0; i < retries; i++ {
+		m := pool.pick(key, tried)
+		if m == nil {
+			break
+		}
+		tried[m] = true
+		var conn net.Conn
+		conn, err = pool.proxy.upstreamDial(c, m.upstream, network, addr)
+		if err != nil && c.Err() != nil {
+			return nil, err
+		}
+		if isDialFailure(err) {
+			pool.report(m, err)
+			pool.proxy.log(LevelWarn, "upstream failed", "upstream", m.upstream.String(), "addr", addr, "error", err)
+			continue
+		}
+		pool.report(m, nil)
+		return conn, err
+	}
+	return nil, err
+}
+
+// isDialFailure tells whether err puts the member at fault: it could not be
+// reached or failed the handshake, or refused the CONNECT as unavailable
+// (503) or for the credentials of the pool (407). Other refusals, such as a
+// 502 for a target it could not reach, are about the target and go to the
+// client.
+func isDialFailure(err error) bool {
+	var refusal *proxyRefusal
+	if errors.As(err, &refusal) {
+		return refusal.status == http.StatusServiceUnavailable || refusal.status == http.StatusProxyAuthRequired
+	}
+	return err != nil
+}
+
+// Proxy picks a pool member for a plain HTTP request, it can be used as
+// http.Transport.Proxy.
+func (pool *UpstreamPool) Proxy(req *http.Request) (*url.URL, error) {
+	m := pool.pick(clientIP(req), nil)
+	if m == nil {
+		return nil, errors.New("upstream pool is empty")
+	}
+	return m.upstream.URL, nil
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (pool *UpstreamPool) StartHealthChecks() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.stop != nil || pool.HealthCheckInterval <= 0 {
+		return
+	}
+	pool.stop = make(chan struct{})
+	stop := pool.stop
+	go func() {
+		ticker := time.NewTicker(pool.HealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			pool.CheckHealth()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (pool *UpstreamPool) Close() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.stop != nil {
+		close(pool.stop)
+		pool.stop = nil
+	}
+}
+
+func (pool *UpstreamPool) CheckHealth() {
+	pool.mu.Lock()
+	members := append([]*poolMember(nil), pool.members...)
+	pool.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, m := range members {
+		wg.Add(1)
+		go func(m *poolMember) {
+			defer wg.Done()
+			err := pool.probe(m)
+			pool.mu.Lock()
+			defer pool.mu.Unlock()
+			m.lastCheck = time.Now()
+			if err == nil {
+				m.down = false
+				m.fails = 0
+				return
+			}
+			pool.failed(m, err)
+		}(m)
+	}
+	wg.Wait()
+}
+
+func (pool *UpstreamPool) probe(m *poolMember) error {
+	c, cancel := context.WithTimeout(context.Background(), pool.HealthCheckTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		var conn net.Conn
+		var err error
+		if pool.HealthCheckTarget == "" {
+			conn, err = pool.proxy.dialContext(c, "tcp", upstreamHostPort(m.upstream.URL))
+		} else {
+			conn, err = pool.proxy.upstreamDial(c, m.upstream, "tcp", pool.HealthCheckTarget)
+		}
+		if err == nil {
+			conn.Close()
+		}
+		if !isDialFailure(err) {
+			err = nil
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-c.Done():
+		return errors.New("health check timed out")
+	}
+}
+
+func upstreamHostPort(u *url.URL) string {
+	if hasPort.MatchString(u.Host) {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https", "wss":
+		return u.Host + ":443"
+	case "socks5", "socks5h":
+		return u.Host + ":1080"
+	}
+	return u.Host + ":80"
+}
+
+func (pool *UpstreamPool) Stats() []UpstreamStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	now := time.Now()
+	stats := make([]UpstreamStats, 0, len(pool.members))
+	for _, m := range pool.members {
+		stats = append(stats, UpstreamStats{
+			URL:        m.upstream.String(),
+			Weight:     m.weight,
+			Healthy:    pool.available(m, now),
+			Fails:      m.fails,
+			TotalFails: m.totalFails,
+			Dials:      m.dials,
+			LastError:  m.lastError,
+			LastCheck:  m.lastCheck,
+		})
+	}
+	return stats
+}
+
+func (pool *UpstreamPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pool.Stats())
+}
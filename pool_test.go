@@ -0,0 +1,176 @@
+package myproxy_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fj9140/myproxy"
+)
+
+func deadProxyURL(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+func TestUpstreamPoolFailover(t *testing.T) {
+	_, upstream := oneShotProxy(doublingProxy(t), t)
+	defer upstream.Close()
+
+	proxy := myproxy.NewProxyHttpServer()
+	pool := proxy.NewUpstreamPool()
+	dead := deadProxyURL(t)
+	panicOnErr(pool.Add(dead, 5), "pool.Add")
+	panicOnErr(pool.Add(upstream.URL, 1), "pool.Add")
+	proxy.ConnectDialWithReq = pool.DialWithReq
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo bobo" {
+			t.Error("Expected CONNECT to fail over to the live upstream, got", r)
+		}
+		client.CloseIdleConnections()
+	}
+
+	stats := pool.Stats()
+	if stats[0].Healthy || stats[0].TotalFails != 1 {
+		t.Errorf("Expected dead member to be down after one failure, got %+v", stats[0])
+	}
+	if !stats[1].Healthy || stats[1].Dials != 3 {
+		t.Errorf("Expected live member to serve every tunnel, got %+v", stats[1])
+	}
+
+	s := httptest.NewServer(pool)
+	defer s.Close()
+	resp, err := http.Get(s.URL)
+	panicOnErr(err, "get pool stats")
+	defer resp.Body.Close()
+	var served []myproxy.UpstreamStats
+	panicOnErr(json.NewDecoder(resp.Body).Decode(&served), "decode pool stats")
+	if len(served) != 2 || served[0].URL != dead {
+		t.Error("Unexpected pool stats", served)
+	}
+}
+
+func TestUpstreamPoolHealthCheck(t *testing.T) {
+	_, upstream := oneShotProxy(doublingProxy(t), t)
+	defer upstream.Close()
+
+	proxy := myproxy.NewProxyHttpServer()
+	pool := proxy.NewUpstreamPool()
+	panicOnErr(pool.Add(deadProxyURL(t), 1), "pool.Add")
+	panicOnErr(pool.Add(upstream.URL, 1), "pool.Add")
+	pool.CheckHealth()
+
+	stats := pool.Stats()
+	if stats[0].Healthy || stats[0].LastCheck.IsZero() {
+		t.Errorf("Expected health check to take dead member down, got %+v", stats[0])
+	}
+	if !stats[1].Healthy {
+		t.Errorf("Expected health check to keep live member up, got %+v", stats[1])
+	}
+}
+
+func TestUpstreamPoolSticky(t *testing.T) {
+	var hits [2]int
+	proxy := myproxy.NewProxyHttpServer()
+	pool := proxy.NewUpstreamPool()
+	pool.Sticky = true
+	for i := range hits {
+		i := i
+		upstreamProxy := myproxy.NewProxyHttpServer()
+		upstreamProxy.OnRequest().HandleConnectFunc(func(host string, ctx *myproxy.ProxyCtx) (*myproxy.ConnectAction, string) {
+			hits[i]++
+			return nil, ""
+		})
+		_, upstream := oneShotProxy(upstreamProxy, t)
+		defer upstream.Close()
+		panicOnErr(pool.Add(upstream.URL, 1), "pool.Add")
+	}
+	proxy.ConnectDialWithReq = pool.DialWithReq
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for i := 0; i < 4; i++ {
+		if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+			t.Error("Expected bobo through sticky pool, got", r)
+		}
+		client.CloseIdleConnections()
+	}
+	if hits[0]+hits[1] != 4 || (hits[0] != 0 && hits[1] != 0) {
+		t.Error("Expected every tunnel of one client on the same member, got", hits)
+	}
+}
+
+func refusingProxy(status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "refused", status)
+	}))
+}
+
+func TestUpstreamPoolRefusals(t *testing.T) {
+	overloaded := refusingProxy(http.StatusServiceUnavailable)
+	defer overloaded.Close()
+	forbidding := refusingProxy(http.StatusForbidden)
+	defer forbidding.Close()
+	_, upstream := oneShotProxy(doublingProxy(t), t)
+	defer upstream.Close()
+
+	proxy := myproxy.NewProxyHttpServer()
+	pool := proxy.NewUpstreamPool()
+	panicOnErr(pool.Add(overloaded.URL, 5), "pool.Add")
+	panicOnErr(pool.Add(upstream.URL, 1), "pool.Add")
+	c, err := pool.Dial("tcp", https.Listener.Addr().String())
+	if err != nil {
+		t.Fatal("Expected a 503 to fail over to the live upstream, got", err)
+	}
+	c.Close()
+	if stats := pool.Stats(); stats[0].Healthy || stats[0].TotalFails != 1 || stats[1].Dials != 1 {
+		t.Errorf("Expected the overloaded member to be down, got %+v", stats)
+	}
+
+	pool = proxy.NewUpstreamPool()
+	panicOnErr(pool.Add(forbidding.URL, 5), "pool.Add")
+	panicOnErr(pool.Add(upstream.URL, 1), "pool.Add")
+	if _, err := pool.Dial("tcp", https.Listener.Addr().String()); err == nil {
+		t.Fatal("Expected the 403 to be returned")
+	}
+	if stats := pool.Stats(); !stats[0].Healthy || stats[0].TotalFails != 0 || stats[1].Dials != 0 {
+		t.Errorf("Expected the 403 not to count as a failure nor fail over, got %+v", stats)
+	}
+
+	pool.HealthCheckTarget = https.Listener.Addr().String()
+	panicOnErr(pool.Add(overloaded.URL, 1), "pool.Add")
+	pool.CheckHealth()
+	if stats := pool.Stats(); !stats[0].Healthy || !stats[1].Healthy || stats[2].Healthy {
+		t.Errorf("Expected health checks to go through the members, got %+v", stats)
+	}
+	unreachable := refusingProxy(http.StatusBadGateway)
+	defer unreachable.Close()
+	pool = proxy.NewUpstreamPool()
+	panicOnErr(pool.Add(unreachable.URL, 5), "pool.Add")
+	panicOnErr(pool.Add(upstream.URL, 1), "pool.Add")
+	if _, err := pool.Dial("tcp", https.Listener.Addr().String()); err == nil {
+		t.Fatal("Expected the 502 to be returned")
+	}
+	if stats := pool.Stats(); !stats[0].Healthy || stats[0].TotalFails != 0 || stats[1].Dials != 0 {
+		t.Errorf("Expected a 502 for the target not to count against the member, got %+v", stats)
+	}
+
+	pool = proxy.NewUpstreamPool()
+	pool.MaxFails = 2
+	pool.HealthCheckTarget = https.Listener.Addr().String()
+	panicOnErr(pool.Add(overloaded.URL, 1), "pool.Add")
+	for i, healthy := range []bool{true, false} {
+		pool.CheckHealth()
+		if stats := pool.Stats(); stats[0].Healthy != healthy {
+			t.Errorf("Expected the member healthy %v after %d failed checks, got %+v", healthy, i+1, stats[0])
+		}
+	}
+}
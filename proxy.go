@@ -2,29 +2,49 @@ package myproxy
 
 import (
 	"bufio"
+	"html/template"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"regexp"
-	"sync/atomic"
+	"sync"
+	texttemplate "text/template"
+	"time"
 )
 
 type ProxyHttpServer struct {
 	Verbose                bool
 	Tr                     *http.Transport
+	sessions               sessions
+	running                int64
+	shuttingDown           int32
 	sess                   int64
 	Logger                 Logger
-	httpsHandlers          []HttpsHandler
+	StructuredLogger       StructuredLogger
+	LogLevel               LogLevel
 	CertStore              CertStorage
 	ConnectDial            func(network string, addr string) (net.Conn, error)
 	ConnectDialWithReq     func(req *http.Request, network string, addr string) (net.Conn, error)
-	reqHandlers            []ReqHandler
-	respHandlers           []RespHandler
+	rules                  handlerRegistry
+	Metrics                *Metrics
+	SpanExporter           SpanExporter
+	ServerTiming           bool
+	TunnelIdleTimeout      time.Duration
+	MaxTunnelLifetime      time.Duration
+	HeaderReadTimeout      time.Duration
+	UpstreamTimeout        time.Duration
+	AccessLog              *AccessLog
+	ErrorTemplate          *template.Template
+	ErrorJSONTemplate      *texttemplate.Template
+	PanicHandler           func(ctx *ProxyCtx, p *HandlerPanic)
 	KeepDestinationHeaders bool
 	KeepHeader             bool
 	NonproxyHandler        http.Handler
+	upstreamMu             sync.Mutex
+	upstreamTransports     map[*Upstream]http.RoundTripper
+	upstreamDialers        map[*Upstream]dialContextFunc
 }
 
 type flushWriter struct {
@@ -83,26 +103,35 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		proxy.handleHttps(w, r)
 	} else {
 		var err error
-		ctx := &ProxyCtx{Req: r, Proxy: proxy, Session: atomic.AddInt64(&proxy.sess, 1)}
+		ctx := proxy.newCtx(r, nil)
+		defer ctx.cancelContext()
 		ctx.Logf("Got request %v %v %v %v", r.URL.Path, r.Host, r.Method, r.URL.String())
 		if !r.URL.IsAbs() {
 			proxy.NonproxyHandler.ServeHTTP(w, r)
 			return
 		}
+		proxy.sessions.add(ctx, ctx.cancel)
+		defer proxy.sessions.done(ctx)
+		ctx.status = http.StatusBadGateway
+		defer proxy.abandon(ctx)
 
+		span := ctx.trace.start("request handlers", SpanKindInternal, nil)
 		r, resp := proxy.filterRequest(r, ctx)
+		ctx.trace.end(span, nil)
 		if resp == nil {
 			if isWebSocketRequest(r) {
 				ctx.Logf("Request looks like websocket upgrade.")
 				proxy.serveWebsocket(ctx, w, r)
+				return
 			}
 
 			if !proxy.KeepHeader {
 				removeProxyHeaders(ctx, r)
 			}
-			resp, err = ctx.RoundTrip(r)
+			resp, err = proxy.roundTrip(r, ctx, sendRoundTrip)
 			if err != nil {
 				ctx.Error = err
+				proxy.Metrics.countError("roundtrip")
 			}
 			if resp != nil {
 				ctx.Logf("Received response %v", resp.Status)
@@ -115,47 +144,60 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			defer origBody.Close()
 		}
 
+		span = ctx.trace.start("response handlers", SpanKindInternal, nil)
 		resp = proxy.filterResponse(resp, ctx)
+		ctx.trace.end(span, nil)
 
 		if resp == nil {
-			var errorString string
-			if ctx.Error != nil {
-				errorString = "error read response" + r.URL.Host + " : " + ctx.Error.Error()
-				ctx.Logf(errorString)
-				http.Error(w, ctx.Error.Error(), 500)
-			} else {
-				errorString = "error read response " + r.URL.Host
-				ctx.Logf(errorString)
-				http.Error(w, errorString, 500)
+			err := ctx.Error
+			if err == nil {
+				err = errNoResponse
 			}
+			status := ClassifyError(err).Status()
+			proxy.Metrics.countRequest(ctx.Req.Method, status, ctx.Req.URL.Hostname())
+			proxy.complete(ctx, status, 0)
+			proxy.writeError(w, ctx, err)
 			return
 		}
 		ctx.Logf("Copying response to client %v [%d]", resp.Status, resp.StatusCode)
 
-		if origBody != resp.Body {
+		if !sameBody(resp.Body, origBody) {
 			resp.Header.Del("Content-Length")
 		}
 
+		resp.Body = &countingBody{ReadCloser: resp.Body, n: &ctx.bytesOut}
 		copyHeaders(w.Header(), resp.Header, proxy.KeepDestinationHeaders)
+		proxy.addServerTiming(w.Header(), ctx)
 		w.WriteHeader(resp.StatusCode)
 		var copyWriter io.Writer = w
 		if w.Header().Get("content-type") == "text/event-stream" {
 			copyWriter = &flushWriter{w: w}
 		}
 
+		span = ctx.trace.start("copy body", SpanKindInternal, nil)
 		nr, err := io.Copy(copyWriter, resp.Body)
+		ctx.trace.end(span, err)
 		if err := resp.Body.Close(); err != nil {
 			ctx.Warnf("Can't close response body %v", err)
 		}
 		ctx.Logf("Copied %v bytes to client error=%v", nr, err)
+		proxy.Metrics.addBytes(0, nr)
+		proxy.Metrics.countRequest(ctx.Req.Method, resp.StatusCode, ctx.Req.URL.Hostname())
+		proxy.complete(ctx, resp.StatusCode, nr)
+		if err != nil {
+			// let the client see the body was cut short
+			panic(http.ErrAbortHandler)
+		}
 	}
 
 }
 
 func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req *http.Request, resp *http.Response) {
 	req = r
-	for _, h := range proxy.reqHandlers {
-		req, resp = h.Handle(r, ctx)
+	for _, h := range ctx.handlers().req {
+		if p := proxy.protect(ctx, "request", func() { req, resp = h.Handle(req, ctx) }); p != nil {
+			return req, ErrorResponse(ctx, p)
+		}
 		if resp != nil {
 			break
 		}
@@ -165,21 +207,54 @@ func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req
 
 func (proxy *ProxyHttpServer) filterResponse(respOrig *http.Response, ctx *ProxyCtx) (resp *http.Response) {
 	resp = respOrig
-	for _, h := range proxy.respHandlers {
+	handlers := ctx.handlers().resp
+	if len(ctx.respHooks) > 0 {
+		handlers = append(append([]RespHandler{}, handlers...), ctx.respHooks...)
+	}
+	for _, h := range handlers {
 		ctx.Resp = resp
-		resp = h.Handle(resp, ctx)
+		if p := proxy.protect(ctx, "response", func() { resp = h.Handle(resp, ctx) }); p != nil {
+			if resp != nil && resp.Body != nil {
+				resp.Body.Close()
+			}
+			return ErrorResponse(ctx, p)
+		}
 	}
 
 	return
 }
 
+func (proxy *ProxyHttpServer) filterTunnel(client net.Conn, ctx *ProxyCtx) net.Conn {
+	for _, h := range ctx.handlers().tunnel {
+		if p := proxy.protect(ctx, "tunnel", func() { client = h.HandleTunnel(client, ctx) }); p != nil {
+			httpError(client, ctx, p)
+			return client
+		}
+		if client == nil {
+			return nil
+		}
+	}
+	return client
+}
+
+// abortTunnel answers the client of a tunnel a handler refused with
+// ctx.Resp, or the page of ErrBlocked, and closes it.
+func (proxy *ProxyHttpServer) abortTunnel(client net.Conn, ctx *ProxyCtx) {
+	if ctx.Resp == nil {
+		httpError(client, ctx, ErrBlocked)
+		return
+	}
+	ctx.status = ctx.Resp.StatusCode
+	if err := ctx.Resp.Write(client); err != nil {
+		ctx.Warnf("Cannot write response that aborted the tunnel: %v", err)
+	}
+	client.Close()
+}
+
 func NewProxyHttpServer() *ProxyHttpServer {
 	proxy := ProxyHttpServer{
-		Tr:            &http.Transport{TLSClientConfig: tlsClientSkipVerify, Proxy: http.ProxyFromEnvironment},
-		Logger:        log.New(os.Stderr, "", log.LstdFlags),
-		reqHandlers:   []ReqHandler{},
-		respHandlers:  []RespHandler{},
-		httpsHandlers: []HttpsHandler{},
+		Tr:     &http.Transport{TLSClientConfig: tlsClientSkipVerify, Proxy: http.ProxyFromEnvironment},
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
 		NonproxyHandler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", 500)
 		}),
@@ -19,6 +19,7 @@ import (
 	"os/exec"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -927,3 +928,191 @@ func TestResponseContentLength(t *testing.T) {
 		t.Fatalf("Wrong response Content-Length.")
 	}
 }
+
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+func TestDoTunnel(t *testing.T) {
+	var read int64
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoTunnelFunc(func(client net.Conn, ctx *myproxy.ProxyCtx) net.Conn {
+		return countingConn{Conn: client, read: &read}
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected bobo through a wrapped tunnel, got", r)
+	}
+	if atomic.LoadInt64(&read) == 0 {
+		t.Error("Expected the tunnel handler to see the client bytes")
+	}
+}
+
+func TestDoTunnelRefuses(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	defer target.Close()
+	var dials int64
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&dials, 1)
+			c.Close()
+		}
+	}()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoTunnelFunc(func(client net.Conn, ctx *myproxy.ProxyCtx) net.Conn {
+		if ctx.Req.Header.Get("X-Refuse") == "slow-down" {
+			ctx.Resp = myproxy.NewResponse(ctx.Req, myproxy.ContentTypeText, http.StatusTooManyRequests, "later")
+		}
+		return nil
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for refuse, expected := range map[string]int{"slow-down": http.StatusTooManyRequests, "": http.StatusForbidden} {
+		c, err := net.Dial("tcp", l.Listener.Addr().String())
+		panicOnErr(err, "dial")
+		host := target.Addr().String()
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nX-Refuse: %s\r\n\r\n", host, host, refuse)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != expected {
+			t.Errorf("Expected the refused tunnel to get %d, got %d", expected, resp.StatusCode)
+		}
+	}
+	if n := atomic.LoadInt64(&dials); n != 0 {
+		t.Errorf("Expected no dial for refused tunnels, got %d", n)
+	}
+}
+
+func TestHTTPMitmRequestCtx(t *testing.T) {
+	type seen struct {
+		session int64
+		connect *myproxy.ProxyCtx
+		remote  string
+	}
+	requests := make(chan seen, 2)
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *myproxy.ProxyCtx) (*myproxy.ConnectAction, string) {
+		return myproxy.HTTPMitmConnect, host
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		requests <- seen{ctx.Session, ctx.ConnectCtx, req.RemoteAddr}
+		return req, nil
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	host := srv.Listener.Addr().String()
+	c, _ := connectThrough(t, l, host)
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for i := 0; i < 2; i++ {
+		fmt.Fprintf(c, "GET /bobo HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadAll(resp.Body); string(b) != "bobo" {
+			t.Error("Expected bobo through the HTTP MITM tunnel, got", string(b))
+		}
+	}
+	first, second := <-requests, <-requests
+	if first.session == second.session || first.connect == nil || first.connect != second.connect {
+		t.Errorf("Expected a ctx per request sharing the CONNECT ctx, got %+v %+v", first, second)
+	}
+	if first.remote != c.LocalAddr().String() {
+		t.Errorf("Expected requests to carry the client address %s, got %s", c.LocalAddr(), first.remote)
+	}
+}
+
+func TestCutResponseAbortsClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		http.ReadRequest(bufio.NewReader(c))
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n")
+		c.Close()
+	}()
+	client, s := oneShotProxy(myproxy.NewProxyHttpServer(), t)
+	defer s.Close()
+
+	// the cut may come before or after the headers were flushed
+	b, err := get("http://"+l.Addr().String(), client)
+	if err == nil {
+		t.Errorf("Expected the client to see the body was cut, got %q", b)
+	}
+}
+
+func TestWebsocketEndsExchange(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	defer l.Close()
+	var upgrades int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+					return
+				}
+				atomic.AddInt32(&upgrades, 1)
+				io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			}()
+		}
+	}()
+	var responses int32
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+		atomic.AddInt32(&responses, 1)
+		return resp
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	panicOnErr(err, "dial proxy")
+	defer c.Close()
+	io.WriteString(c, "GET http://"+l.Addr().String()+"/ws HTTP/1.1\r\nHost: "+l.Addr().String()+
+		"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	panicOnErr(err, "read upgrade")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("Expected the upgrade, got", resp.StatusCode)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(ioutil.Discard, br)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&upgrades); n != 1 {
+		t.Error("Expected the upgrade to reach the target once, got", n)
+	}
+	if n := atomic.LoadInt32(&responses); n != 1 {
+		t.Error("Expected the exchange to end with the websocket, got responses", n)
+	}
+}
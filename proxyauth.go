@@ -0,0 +1,443 @@
+package myproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const maxProxyAuthRounds = 4
+
+// ProxyAuth holds the credentials used to answer 407 challenges from an
+// upstream proxy. Basic, Digest and NTLMv2 are supported, the strongest
+// scheme offered by the proxy is used. NTLM authenticates the connection
+// rather than the request, so its handshake is kept on a single connection.
+// Username may be given as DOMAIN\user for NTLM.
+type ProxyAuth struct {
+	Username    string
+	Password    string
+	Domain      string
+	Workstation string
+	Preemptive  bool
+
+	mu     sync.Mutex
+	digest *digestChallenge
+	nc     int
+}
+
+type proxyConn struct {
+	net.Conn
+	br            *bufio.Reader
+	authenticated bool
+}
+
+type proxyAuthState struct {
+	scheme string
+	done   bool
+}
+
+func (a *ProxyAuth) user() (user, domain string) {
+	if i := strings.IndexRune(a.Username, '\\'); i >= 0 {
+		return a.Username[i+1:], a.Username[:i]
+	}
+	return a.Username, a.Domain
+}
+
+func (a *ProxyAuth) basic() string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.Username+":"+a.Password))
+}
+
+func (a *ProxyAuth) initial(req *http.Request, pc *proxyConn) string {
+	if pc.authenticated {
+		return ""
+	}
+	a.mu.Lock()
+	cached := a.digest
+	a.mu.Unlock()
+	if cached != nil {
+		return a.digestAuthorization(cached, req)
+	}
+	if a.Preemptive {
+		return a.basic()
+	}
+	return ""
+}
+
+func (a *ProxyAuth) answer(challenges []string, req *http.Request, st *proxyAuthState) (string, error) {
+	offered := make(map[string]string)
+	for _, c := range challenges {
+		scheme, params := c, ""
+		if i := strings.IndexRune(c, ' '); i >= 0 {
+			scheme, params = c[:i], strings.TrimSpace(c[i+1:])
+		}
+		offered[strings.ToLower(scheme)] = params
+	}
+
+	if st.scheme == "ntlm" && !st.done {
+		token, ok := offered["ntlm"]
+		if !ok || token == "" {
+			return "", errors.New("ntlm: upstream proxy did not send a challenge")
+		}
+		msg, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return "", err
+		}
+		challenge, err := parseNTLMChallenge(msg)
+		if err != nil {
+			return "", err
+		}
+		user, domain := a.user()
+		auth, err := ntlmAuthenticateMessage(challenge, user, a.Password, domain, a.Workstation)
+		if err != nil {
+			return "", err
+		}
+		st.done = true
+		return "NTLM " + base64.StdEncoding.EncodeToString(auth), nil
+	}
+
+	if params, ok := offered["digest"]; ok && st.scheme == "digest" {
+		if c := parseDigestChallenge(params); strings.EqualFold(c.stale, "true") {
+			a.setDigest(c)
+			return a.digestAuthorization(c, req), nil
+		}
+	}
+	if st.done {
+		return "", nil
+	}
+
+	if _, ok := offered["ntlm"]; ok {
+		st.scheme = "ntlm"
+		return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()), nil
+	}
+	if params, ok := offered["digest"]; ok {
+		c := parseDigestChallenge(params)
+		a.setDigest(c)
+		st.scheme, st.done = "digest", true
+		return a.digestAuthorization(c, req), nil
+	}
+	if _, ok := offered["basic"]; ok {
+		st.scheme, st.done = "basic", true
+		return a.basic(), nil
+	}
+	return "", nil
+}
+
+// roundTrip sends req to the upstream proxy over pc and answers its 407
+// challenges. When the proxy closes the connection between rounds a new one
+// is dialed with redial, so the returned connection may differ from pc.
+func (a *ProxyAuth) roundTrip(pc *proxyConn, req *http.Request, write func(io.Writer, *http.Request) error,
+	redial func() (*proxyConn, error)) (*proxyConn, *http.Response, error) {
+	var st proxyAuthState
+	authz := a.initial(req, pc)
+	for round := 0; ; round++ {
+		if authz != "" {
+			req.Header.Set("Proxy-Authorization", authz)
+		} else {
+			req.Header.Del("Proxy-Authorization")
+		}
+		if round > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return pc, nil, err
+			}
+			req.Body = body
+		}
+		if err := write(pc, req); err != nil {
+			return pc, nil, err
+		}
+		resp, err := http.ReadResponse(pc.br, req)
+		if err != nil {
+			return pc, nil, err
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			if st.scheme == "ntlm" && st.done {
+				pc.authenticated = true
+			}
+			return pc, resp, nil
+		}
+		if round+1 >= maxProxyAuthRounds || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+			return pc, resp, nil
+		}
+		next, err := a.answer(resp.Header.Values("Proxy-Authenticate"), req, &st)
+		if err != nil || next == "" {
+			return pc, resp, err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.Close {
+			pc.Close()
+			if pc, err = redial(); err != nil {
+				return nil, nil, err
+			}
+			if st.scheme == "ntlm" && st.done {
+				st = proxyAuthState{scheme: "ntlm"}
+				next = "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage())
+			}
+		}
+		authz = next
+	}
+}
+
+type digestChallenge struct {
+	realm, nonce, opaque, qop, algorithm, stale string
+}
+
+func parseDigestChallenge(s string) *digestChallenge {
+	c := &digestChallenge{}
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexRune(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimSpace(s[eq+1:])
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++
+			}
+			val, s = b.String(), s[i:]
+		} else {
+			end := strings.IndexRune(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			val, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		switch key {
+		case "realm":
+			c.realm = val
+		case "nonce":
+			c.nonce = val
+		case "opaque":
+			c.opaque = val
+		case "qop":
+			c.qop = val
+		case "algorithm":
+			c.algorithm = val
+		case "stale":
+			c.stale = val
+		}
+	}
+	return c
+}
+
+func (a *ProxyAuth) setDigest(c *digestChallenge) {
+	a.mu.Lock()
+	a.digest, a.nc = c, 0
+	a.mu.Unlock()
+}
+
+func (a *ProxyAuth) digestAuthorization(c *digestChallenge, req *http.Request) string {
+	a.mu.Lock()
+	a.nc++
+	nc := fmt.Sprintf("%08x", a.nc)
+	a.mu.Unlock()
+
+	var h func() hash.Hash = md5.New
+	algorithm := strings.ToUpper(c.algorithm)
+	if strings.HasPrefix(algorithm, "SHA-256") {
+		h = sha256.New
+	}
+	hexHash := func(parts ...string) string {
+		d := h()
+		io.WriteString(d, strings.Join(parts, ":"))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	uri := req.URL.RequestURI()
+	if req.Method == http.MethodConnect {
+		uri = req.Host
+	} else if req.URL.IsAbs() {
+		uri = req.URL.String()
+	}
+	cnonceBytes := make([]byte, 8)
+	rand.Read(cnonceBytes)
+	cnonce := hex.EncodeToString(cnonceBytes)
+
+	ha1 := hexHash(a.Username, c.realm, a.Password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = hexHash(ha1, c.nonce, cnonce)
+	}
+	ha2 := hexHash(req.Method, uri)
+
+	var qop string
+	for _, q := range strings.Split(c.qop, ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s"`, a.Username, c.realm, c.nonce, uri)
+	if qop != "" {
+		fmt.Fprintf(&b, `, qop=%s, nc=%s, cnonce="%s", response="%s"`, qop, nc, cnonce, hexHash(ha1, c.nonce, nc, cnonce, qop, ha2))
+	} else {
+		fmt.Fprintf(&b, `, response="%s"`, hexHash(ha1, c.nonce, ha2))
+	}
+	if c.algorithm != "" {
+		fmt.Fprintf(&b, ", algorithm=%s", c.algorithm)
+	}
+	if c.opaque != "" {
+		fmt.Fprintf(&b, `, opaque="%s"`, c.opaque)
+	}
+	return b.String()
+}
+
+func (proxy *ProxyHttpServer) dialProxyConn(ctx context.Context, u *url.URL, network string) (*proxyConn, error) {
+	c, err := proxy.dialContext(ctx, network, upstreamHostPort(u))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		c = tls.Client(c, proxy.Tr.TLSClientConfig)
+	}
+	return &proxyConn{Conn: c, br: bufio.NewReader(c)}, nil
+}
+
+// proxyAuthTransport forwards plain HTTP requests to an upstream proxy that
+// requires authentication, keeping authenticated connections for reuse.
+// HTTPS requests are tunneled through an authenticated CONNECT.
+type proxyAuthTransport struct {
+	proxy    *ProxyHttpServer
+	upstream *Upstream
+	tunnel   *http.Transport
+
+	mu   sync.Mutex
+	idle []*proxyConn
+}
+
+func (proxy *ProxyHttpServer) newProxyAuthTransport(u *Upstream) *proxyAuthTransport {
+	tunnel := proxy.Tr.Clone()
+	tunnel.Proxy = nil
+	tunnel.Dial = nil
+	tunnel.DialContext = func(c context.Context, network, addr string) (net.Conn, error) {
+		return proxy.upstreamDial(c, u, network, addr)
+	}
+	return &proxyAuthTransport{proxy: proxy, upstream: u, tunnel: tunnel}
+}
+
+func (t *proxyAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" || t.upstream.bypass(upstreamHostPort(req.URL)) {
+		return t.tunnel.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil &&
+		req.ContentLength >= 0 && req.ContentLength <= 1<<20 {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+
+	pc := t.getIdle()
+	if pc == nil {
+		var err error
+		if pc, err = t.proxy.dialProxyConn(req.Context(), t.upstream.URL, "tcp"); err != nil {
+			return nil, err
+		}
+	}
+	redial := func() (*proxyConn, error) {
+		return t.proxy.dialProxyConn(req.Context(), t.upstream.URL, "tcp")
+	}
+	write := func(w io.Writer, req *http.Request) error {
+		return req.WriteProxy(w)
+	}
+	pc, resp, err := t.upstream.Auth.roundTrip(pc, req, write, redial)
+	if err != nil {
+		if pc != nil {
+			pc.Close()
+		}
+		return nil, err
+	}
+	resp.Body = &proxyConnBody{ReadCloser: resp.Body, t: t, pc: pc, reuse: !resp.Close && !req.Close}
+	return resp, nil
+}
+
+func (t *proxyAuthTransport) getIdle() *proxyConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n := len(t.idle); n > 0 {
+		pc := t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		return pc
+	}
+	return nil
+}
+
+func (t *proxyAuthTransport) putIdle(pc *proxyConn) {
+	max := t.proxy.Tr.MaxIdleConnsPerHost
+	if max <= 0 {
+		max = http.DefaultMaxIdleConnsPerHost
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle) >= max {
+		pc.Close()
+		return
+	}
+	t.idle = append(t.idle, pc)
+}
+
+func (t *proxyAuthTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	idle := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+	for _, pc := range idle {
+		pc.Close()
+	}
+	t.tunnel.CloseIdleConnections()
+}
+
+type proxyConnBody struct {
+	io.ReadCloser
+	t      *proxyAuthTransport
+	pc     *proxyConn
+	reuse  bool
+	closed bool
+}
+
+func (b *proxyConnBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	err := b.ReadCloser.Close()
+	if err == nil && b.reuse {
+		b.t.putIdle(b.pc)
+	} else {
+		b.pc.Close()
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package myproxy_test
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fj9140/myproxy"
+)
+
+const testNTLMChallenge = "TlRMTVNTUAACAAAAAAAAADAAAAABgggAASNFZ4mrze8AAAAAAAAAAAAAAAAwAAAA"
+
+func md5Hex(parts ...string) string {
+	sum := md5.Sum([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(sum[:])
+}
+
+func digestParams(h string) map[string]string {
+	params := make(map[string]string)
+	for _, p := range strings.Split(strings.TrimPrefix(h, "Digest "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return params
+}
+
+// serveAuthProxy runs a minimal upstream proxy requiring the given scheme
+// from user "user" with password "pass".
+func serveAuthProxy(t *testing.T, scheme string) (proxyURL string, handshakes *int, closer func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	handshakes = new(int)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				challenged, authenticated := false, false
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					authz := req.Header.Get("Proxy-Authorization")
+					ok := false
+					switch scheme {
+					case "Basic":
+						ok = authz == "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass"))
+					case "Digest":
+						p := digestParams(authz)
+						ha1 := md5Hex("user", "test", "pass")
+						ha2 := md5Hex(req.Method, p["uri"])
+						ok = p["username"] == "user" && p["nonce"] == "abc" &&
+							p["response"] == md5Hex(ha1, "abc", p["nc"], p["cnonce"], p["qop"], ha2)
+					case "NTLM":
+						msg, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(authz, "NTLM "))
+						if len(msg) > 8 && msg[8] == 1 {
+							challenged = true
+							*handshakes++
+							io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM "+testNTLMChallenge+"\r\nContent-Length: 0\r\n\r\n")
+							continue
+						}
+						authenticated = authenticated || challenged && len(msg) > 8 && msg[8] == 3
+						ok = authenticated
+					}
+					if !ok {
+						challenge := scheme + ` realm="test"`
+						if scheme == "Digest" {
+							challenge += `, nonce="abc", qop="auth"`
+						} else if scheme == "NTLM" {
+							challenge = "NTLM"
+						}
+						io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: "+challenge+"\r\nContent-Length: 0\r\n\r\n")
+						io.Copy(ioutil.Discard, req.Body)
+						continue
+					}
+					if req.Method == "CONNECT" {
+						target, err := net.Dial("tcp", req.Host)
+						if err != nil {
+							io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+							return
+						}
+						defer target.Close()
+						io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+						go io.Copy(target, br)
+						io.Copy(c, target)
+						return
+					}
+					req.RequestURI = ""
+					req.Header.Del("Proxy-Authorization")
+					resp, err := http.DefaultTransport.RoundTrip(req)
+					if err != nil {
+						return
+					}
+					resp.Write(c)
+					resp.Body.Close()
+				}
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String(), handshakes, func() { l.Close() }
+}
+
+func TestConnectDialToProxyWithAuth(t *testing.T) {
+	for _, scheme := range []string{"Basic", "Digest", "NTLM"} {
+		proxyURL, _, closer := serveAuthProxy(t, scheme)
+		defer closer()
+
+		auth := &myproxy.ProxyAuth{Username: "user", Password: "pass"}
+		if scheme == "NTLM" {
+			auth.Username = "DOMAIN\\user"
+		}
+		proxy := myproxy.NewProxyHttpServer()
+		proxy.ConnectDial = proxy.NewConnectDialToProxyWithAuth(proxyURL, auth)
+		client, l := oneShotProxy(proxy, t)
+		defer l.Close()
+
+		if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+			t.Errorf("Expected bobo through %s authenticated upstream, got %s", scheme, r)
+		}
+	}
+}
+
+func TestConnectDialToProxyWithBadAuth(t *testing.T) {
+	proxyURL, _, closer := serveAuthProxy(t, "Digest")
+	defer closer()
+
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.ConnectDial = proxy.NewConnectDialToProxyWithAuth(proxyURL, &myproxy.ProxyAuth{Username: "user", Password: "wrong"})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if _, err := client.Get(https.URL + "/bobo"); err == nil {
+		t.Error("Expected CONNECT with a wrong password to fail")
+	}
+}
+
+func TestUpstreamAuthPlainHttp(t *testing.T) {
+	for _, scheme := range []string{"Basic", "Digest", "NTLM"} {
+		proxyURL, handshakes, closer := serveAuthProxy(t, scheme)
+		defer closer()
+
+		u, _ := url.Parse(proxyURL)
+		proxy := myproxy.NewProxyHttpServer()
+		proxy.OnRequest().RouteTo(&myproxy.Upstream{URL: u, Auth: &myproxy.ProxyAuth{Username: "user", Password: "pass"}})
+		client, l := oneShotProxy(proxy, t)
+		defer l.Close()
+
+		for i := 0; i < 2; i++ {
+			if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "bobo" {
+				t.Errorf("Expected bobo through %s authenticated upstream, got %s", scheme, r)
+			}
+		}
+		resp, err := client.PostForm(srv.URL+"/query", url.Values{"result": {"bar"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "bar" {
+			t.Errorf("Expected POST body to survive %s authentication, got %s", scheme, b)
+		}
+		if scheme == "NTLM" && *handshakes != 1 {
+			t.Error("Expected NTLM authenticated connection to be reused, handshakes:", *handshakes)
+		}
+	}
+}
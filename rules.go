@@ -0,0 +1,243 @@
+package myproxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Registration is a handler added to a proxy, it can be removed while the
+// proxy serves traffic.
+type Registration struct {
+	proxy *ProxyHttpServer
+	id    int64
+}
+
+// Remove takes the handler out of the proxy, and tells whether it was still
+// there. Requests already running it are not affected.
+func (r *Registration) Remove() bool {
+	removed := false
+	r.proxy.rules.update(func(entries []*handlerEntry) []*handlerEntry {
+		kept := entries[:0:0]
+		for _, e := range entries {
+			if e.id == r.id {
+				removed = true
+				continue
+			}
+			kept = append(kept, e)
+		}
+		return kept
+	})
+	return removed
+}
+
+type handlerEntry struct {
+	id       int64
+	priority int
+	group    string
+	req      ReqHandler
+	resp     RespHandler
+	https    HttpsHandler
+	tunnel   TunnelHandler
+}
+
+// handlerOptions are how and where the handlers of a ReqProxyConds or a
+// ProxyConds are registered.
+type handlerOptions struct {
+	priority int
+	group    string
+	rules    *Rules
+}
+
+// handlerTable is a snapshot of the handlers of a proxy, in the order they
+// run. It is never modified once stored.
+type handlerTable struct {
+	req    []ReqHandler
+	resp   []RespHandler
+	https  []HttpsHandler
+	tunnel []TunnelHandler
+
+	routes      []upstreamRoute
+	middlewares []Middleware
+}
+
+type handlerRegistry struct {
+	mu          sync.Mutex
+	entries     []*handlerEntry
+	disabled    map[string]bool
+	routes      []upstreamRoute
+	middlewares []Middleware
+	lastID      int64
+	table       atomic.Value
+}
+
+func (r *handlerRegistry) update(f func(entries []*handlerEntry) []*handlerEntry) {
+	r.change(func() { r.entries = f(r.entries) })
+}
+
+// change runs f, which modifies the registry, and stores the new table.
+func (r *handlerRegistry) change(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f()
+	r.rebuild()
+}
+
+// rebuild stores a new table of the enabled handlers, by decreasing priority
+// then in order of registration.
+func (r *handlerRegistry) rebuild() {
+	entries := make([]*handlerEntry, 0, len(r.entries))
+	for _, e := range r.entries {
+		if !r.disabled[e.group] {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].priority > entries[j].priority
+	})
+	t := &handlerTable{routes: r.routes, middlewares: r.middlewares}
+	for _, e := range entries {
+		switch {
+		case e.req != nil:
+			t.req = append(t.req, e.req)
+		case e.resp != nil:
+			t.resp = append(t.resp, e.resp)
+		case e.https != nil:
+			t.https = append(t.https, e.https)
+		case e.tunnel != nil:
+			t.tunnel = append(t.tunnel, e.tunnel)
+		}
+	}
+	r.table.Store(t)
+}
+
+func (proxy *ProxyHttpServer) handlers() *handlerTable {
+	if t, ok := proxy.rules.table.Load().(*handlerTable); ok {
+		return t
+	}
+	return &handlerTable{}
+}
+
+// handlers is the table the exchange of ctx runs, loaded when ctx was made
+// so that changes to the handlers don't reach it halfway.
+func (ctx *ProxyCtx) handlers() *handlerTable {
+	if ctx.table == nil {
+		ctx.table = ctx.Proxy.handlers()
+	}
+	return ctx.table
+}
+
+func (proxy *ProxyHttpServer) addHandler(opts handlerOptions, e *handlerEntry) *Registration {
+	e.id = atomic.AddInt64(&proxy.rules.lastID, 1)
+	e.priority, e.group = opts.priority, opts.group
+	if opts.rules != nil {
+		e.group = opts.rules.group
+		opts.rules.entries = append(opts.rules.entries, e)
+	} else {
+		proxy.rules.update(func(entries []*handlerEntry) []*handlerEntry {
+			return append(entries, e)
+		})
+	}
+	return &Registration{proxy, e.id}
+}
+
+// Priority makes the handlers registered with pcond run before those of
+// lower priority, whatever their order of registration. The default is 0.
+func (pcond *ReqProxyConds) Priority(p int) *ReqProxyConds {
+	c := *pcond
+	c.priority = p
+	return &c
+}
+
+// Group puts the handlers registered with pcond in the named group, to be
+// disabled, removed or replaced together.
+func (pcond *ReqProxyConds) Group(name string) *ReqProxyConds {
+	c := *pcond
+	c.group = name
+	return &c
+}
+
+func (pcond *ProxyConds) Priority(p int) *ProxyConds {
+	c := *pcond
+	c.priority = p
+	return &c
+}
+
+func (pcond *ProxyConds) Group(name string) *ProxyConds {
+	c := *pcond
+	c.group = name
+	return &c
+}
+
+// SetGroupEnabled turns the handlers of a group off or back on.
+func (proxy *ProxyHttpServer) SetGroupEnabled(group string, enabled bool) {
+	proxy.rules.update(func(entries []*handlerEntry) []*handlerEntry {
+		if proxy.rules.disabled == nil {
+			proxy.rules.disabled = make(map[string]bool)
+		}
+		if enabled {
+			delete(proxy.rules.disabled, group)
+		} else {
+			proxy.rules.disabled[group] = true
+		}
+		return entries
+	})
+}
+
+// RemoveGroup removes the handlers of a group and returns how many there
+// were.
+func (proxy *ProxyHttpServer) RemoveGroup(group string) int {
+	return proxy.replaceGroup(group, nil)
+}
+
+// Rules are handlers staged by ReplaceGroup.
+type Rules struct {
+	proxy   *ProxyHttpServer
+	group   string
+	entries []*handlerEntry
+}
+
+func (rules *Rules) OnRequest(conds ...ReqCondition) *ReqProxyConds {
+	return &ReqProxyConds{proxy: rules.proxy, reqConds: conds, handlerOptions: handlerOptions{rules: rules}}
+}
+
+func (rules *Rules) OnResponse(conds ...RespCondition) *ProxyConds {
+	return &ProxyConds{proxy: rules.proxy, respConds: conds, handlerOptions: handlerOptions{rules: rules}}
+}
+
+// ReplaceGroup swaps the handlers of a group for those build registers, at
+// once: every request runs either the old handlers or the new ones. The new
+// handlers take the place of the old ones in the order of registration.
+//
+//	proxy.ReplaceGroup("blocklist", func(rules *myproxy.Rules) {
+//		for _, host := range blocked {
+//			rules.OnRequest(myproxy.DstHostIs(host)).HandleConnect(myproxy.AlwaysReject)
+//		}
+//	})
+func (proxy *ProxyHttpServer) ReplaceGroup(group string, build func(rules *Rules)) {
+	rules := &Rules{proxy: proxy, group: group}
+	build(rules)
+	proxy.replaceGroup(group, rules.entries)
+}
+
+func (proxy *ProxyHttpServer) replaceGroup(group string, replacement []*handlerEntry) int {
+	removed := 0
+	proxy.rules.update(func(entries []*handlerEntry) []*handlerEntry {
+		kept := make([]*handlerEntry, 0, len(entries)+len(replacement))
+		for _, e := range entries {
+			if e.group != group {
+				kept = append(kept, e)
+				continue
+			}
+			if removed == 0 {
+				kept = append(kept, replacement...)
+			}
+			removed++
+		}
+		if removed == 0 {
+			kept = append(kept, replacement...)
+		}
+		return kept
+	})
+	return removed
+}
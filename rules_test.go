@@ -0,0 +1,196 @@
+package myproxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+func rulesOrigin() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Join(r.Header["X-Rule"], ",")))
+	}))
+}
+
+func addRule(name string) func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+	return func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		req.Header.Add("X-Rule", name)
+		return req, nil
+	}
+}
+
+func TestRemoveHandler(t *testing.T) {
+	origin := rulesOrigin()
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(addRule("a"))
+	b := proxy.OnRequest().DoFunc(addRule("b"))
+	proxy.OnRequest().DoFunc(addRule("c"))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(origin.URL, client, t)); r != "a,b,c" {
+		t.Error("Expected all rules, got", r)
+	}
+	if !b.Remove() {
+		t.Error("Expected the rule to be removed")
+	}
+	if b.Remove() {
+		t.Error("Expected a second removal to do nothing")
+	}
+	if r := string(getOrFail(origin.URL, client, t)); r != "a,c" {
+		t.Error("Expected the rule to be gone, got", r)
+	}
+}
+
+func TestHandlerPriority(t *testing.T) {
+	origin := rulesOrigin()
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(addRule("default"))
+	proxy.OnRequest().Priority(-1).DoFunc(addRule("last"))
+	proxy.OnRequest().Priority(10).DoFunc(addRule("first"))
+	proxy.OnRequest().Priority(10).DoFunc(addRule("second"))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(origin.URL, client, t)); r != "first,second,default,last" {
+		t.Error("Expected rules by priority then registration, got", r)
+	}
+}
+
+func TestHandlerGroups(t *testing.T) {
+	origin := rulesOrigin()
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(addRule("a"))
+	proxy.OnRequest().Group("debug").DoFunc(addRule("debug1"))
+	proxy.OnRequest().DoFunc(addRule("b"))
+	proxy.OnRequest().Group("debug").DoFunc(addRule("debug2"))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, tc := range []struct {
+		change   func()
+		expected string
+	}{
+		{func() {}, "a,debug1,b,debug2"},
+		{func() { proxy.SetGroupEnabled("debug", false) }, "a,b"},
+		{func() { proxy.SetGroupEnabled("debug", true) }, "a,debug1,b,debug2"},
+		{func() {
+			proxy.ReplaceGroup("debug", func(rules *myproxy.Rules) {
+				rules.OnRequest().DoFunc(addRule("new1"))
+				rules.OnRequest().DoFunc(addRule("new2"))
+			})
+		}, "a,new1,new2,b"},
+		{func() {
+			if n := proxy.RemoveGroup("debug"); n != 2 {
+				t.Error("Expected two rules removed, got", n)
+			}
+		}, "a,b"},
+	} {
+		tc.change()
+		if r := string(getOrFail(origin.URL, client, t)); r != tc.expected {
+			t.Errorf("Expected %q, got %q", tc.expected, r)
+		}
+	}
+}
+
+func TestReplaceGroupWhileServing(t *testing.T) {
+	origin := rulesOrigin()
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			v := fmt.Sprint("v", i)
+			proxy.ReplaceGroup("rules", func(rules *myproxy.Rules) {
+				rules.OnRequest().DoFunc(addRule(v))
+				rules.OnRequest().DoFunc(addRule(v))
+			})
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		r := strings.Split(string(getOrFail(origin.URL, client, t)), ",")
+		if len(r) == 2 && r[0] != r[1] {
+			t.Fatalf("Expected a request to see a single version of the rules, got %v", r)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestReplaceGroupBetweenRequestAndResponse(t *testing.T) {
+	origin := rulesOrigin()
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	var version func(v string) func(rules *myproxy.Rules)
+	version = func(v string) func(rules *myproxy.Rules) {
+		return func(rules *myproxy.Rules) {
+			rules.OnRequest().DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+				if v == "v1" {
+					proxy.ReplaceGroup("pair", version("v2"))
+				}
+				return req, nil
+			})
+			rules.OnResponse().DoFunc(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+				resp.Header.Set("X-Version", v)
+				return resp
+			})
+		}
+	}
+	proxy.ReplaceGroup("pair", version("v1"))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, expected := range []string{"v1", "v2"} {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if v := resp.Header.Get("X-Version"); v != expected {
+			t.Errorf("Expected the response handlers of %s, got %q", expected, v)
+		}
+	}
+}
+
+func TestRegisterWhileServing(t *testing.T) {
+	origin := rulesOrigin()
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			proxy.Use(func(next myproxy.RoundTripperFunc) myproxy.RoundTripperFunc { return next })
+			proxy.OnRequest(myproxy.DstHostIs("unrouted.example")).RouteTo(&myproxy.Upstream{})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		getOrFail(origin.URL, client, t)
+	}
+	wg.Wait()
+}
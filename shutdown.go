@@ -0,0 +1,102 @@
+package myproxy
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const shutdownPollInterval = 50 * time.Millisecond
+
+// spawn runs f in a goroutine Shutdown waits for.
+func (proxy *ProxyHttpServer) spawn(f func()) {
+	atomic.AddInt64(&proxy.running, 1)
+	go func() {
+		defer atomic.AddInt64(&proxy.running, -1)
+		f()
+	}()
+}
+
+func (proxy *ProxyHttpServer) closing() bool {
+	return atomic.LoadInt32(&proxy.shuttingDown) != 0
+}
+
+// waitRequest marks a MITM session as waiting for the next request of its
+// client, and tells whether it should rather end as the proxy is shutting
+// down.
+func (proxy *ProxyHttpServer) waitRequest(ctx *ProxyCtx) bool {
+	proxy.sessions.setIdle(ctx, true)
+	return proxy.closing()
+}
+
+func (proxy *ProxyHttpServer) gotRequest(ctx *ProxyCtx) {
+	proxy.sessions.setIdle(ctx, false)
+}
+
+func (s *sessions) setIdle(ctx *ProxyCtx, idle bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry := s.m[ctx.Session]; entry != nil {
+		entry.idle = idle
+	}
+}
+
+// closeIdle kills the sessions waiting for a request, and tells whether
+// there were none left at all.
+func (s *sessions) closeIdle() bool {
+	s.mu.Lock()
+	var idle []int64
+	for id, entry := range s.m {
+		if entry.idle {
+			idle = append(idle, id)
+		}
+	}
+	empty := len(s.m) == 0
+	s.mu.Unlock()
+	for _, id := range idle {
+		s.kill(id)
+	}
+	return empty
+}
+
+func (s *sessions) killAll() {
+	s.mu.Lock()
+	ids := make([]int64, 0, len(s.m))
+	for id := range s.m {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	for _, id := range ids {
+		s.kill(id)
+	}
+}
+
+// Shutdown gracefully stops the proxy: new CONNECTs are answered 503, MITM
+// sessions are closed once the request they are serving is answered, and
+// tunnels and websockets are left to finish. If ctx expires first, all that
+// is left is closed and ctx.Err() returned.
+//
+// The listener is not closed: call http.Server.Shutdown as well, which does
+// not wait for hijacked connections.
+func (proxy *ProxyHttpServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&proxy.shuttingDown, 1)
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if proxy.sessions.closeIdle() && atomic.LoadInt64(&proxy.running) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			proxy.sessions.killAll()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func rejectShuttingDown(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	http.Error(w, "Proxy is shutting down", http.StatusServiceUnavailable)
+}
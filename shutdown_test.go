@@ -0,0 +1,146 @@
+package myproxy_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func connectThrough(t *testing.T, proxy *httptest.Server, host string) (net.Conn, *http.Response) {
+	c, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, resp
+}
+
+func TestShutdownDrainsTunnels(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, resp := connectThrough(t, l, echo.Addr().String())
+	if resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT", resp.Status)
+	}
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- proxy.Shutdown(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+
+	if _, resp := connectThrough(t, l, echo.Addr().String()); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Expected new CONNECTs to be refused, got", resp.Status)
+	}
+	fmt.Fprint(c, "still open")
+	buf := make([]byte, len("still open"))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "still open" {
+		t.Errorf("Expected tunnel to keep working while draining, got %q %v", buf, err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatal("Shutdown returned with a tunnel open", err)
+	default:
+	}
+
+	c.Close()
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Error("Expected a clean shutdown, got", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Shutdown did not return once the tunnel was closed")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, _ := connectThrough(t, l, echo.Addr().String())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected the deadline to expire, got", err)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Error("Expected tunnel to be closed at the deadline, got", err)
+	}
+}
+
+func TestShutdownFinishesMitmRequest(t *testing.T) {
+	arrived := make(chan bool)
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	shutdown := make(chan error, 1)
+	go func() {
+		<-arrived
+		shutdown <- proxy.Shutdown(context.Background())
+	}()
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatal("Expected in-flight MITM request to finish, got", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "done" {
+		t.Errorf("Expected the whole response, got %q", b)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Error("Expected a clean shutdown, got", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Shutdown did not return once the MITM request was answered")
+	}
+}
@@ -0,0 +1,173 @@
+package myproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	socks5Version      = 5
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5CmdConnect   = 1
+	socks5AtypIPv4     = 1
+	socks5AtypDomain   = 3
+	socks5AtypIPv6     = 4
+)
+
+func (proxy *ProxyHttpServer) dialSocks5(ctx context.Context, u *url.URL, network, addr string) (net.Conn, error) {
+	proxyAddr := u.Host
+	if !hasPort.MatchString(proxyAddr) {
+		proxyAddr += ":1080"
+	}
+	// socks5:// resolves names locally, socks5h:// lets the proxy do it
+	if u.Scheme == "socks5" {
+		resolved, err := resolveAddr(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = resolved
+	}
+	c, err := proxy.dialContext(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	stop := interruptOn(ctx, c)
+	err = socks5Handshake(c, u.User, addr)
+	if stop() {
+		c.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func resolveAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("socks5: no address for %s", host)
+	}
+	return net.JoinHostPort(ips[0].IP.String(), port), nil
+}
+
+func socks5Handshake(c io.ReadWriter, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xFFFF {
+		return errors.New("socks5: bad port " + portStr)
+	}
+
+	greeting := []byte{socks5Version, 1, socks5AuthNone}
+	if user != nil {
+		greeting = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := c.Write(greeting); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return errors.New("socks5: unexpected protocol version " + strconv.Itoa(int(buf[0])))
+	}
+	switch buf[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if user == nil {
+			return errors.New("socks5: proxy requires authentication")
+		}
+		name := user.Username()
+		pass, _ := user.Password()
+		if len(name) > 255 || len(pass) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+		req := []byte{1, byte(len(name))}
+		req = append(req, name...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := c.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("socks5: authentication failed")
+		}
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AtypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AtypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("socks5: host name too long " + host)
+		}
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		// code 2 is the socks5 equivalent of a 403, others of a 502
+		status := http.StatusBadGateway
+		if reply[1] == 2 {
+			status = http.StatusForbidden
+		}
+		return &proxyRefusal{status: status, msg: fmt.Sprintf("socks5: %v, code %d", errProxyRefused, reply[1])}
+	}
+	var skip int
+	switch reply[3] {
+	case socks5AtypIPv4:
+		skip = net.IPv4len
+	case socks5AtypIPv6:
+		skip = net.IPv6len
+	case socks5AtypDomain:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return errors.New("socks5: unknown address type in reply")
+	}
+	_, err = io.ReadFull(c, make([]byte, skip+2))
+	return err
+}
@@ -0,0 +1,177 @@
+package myproxy
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamTimeout limits the requests it handles to d, from sending them
+// upstream to the end of the response body, instead of the proxy's
+// UpstreamTimeout. Zero means no limit.
+//
+//	proxy.OnRequest(myproxy.UrlMatches(downloads)).Do(myproxy.UpstreamTimeout(time.Hour))
+func UpstreamTimeout(d time.Duration) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.upstreamTimeout, ctx.upstreamTimeoutSet = d, true
+		return req, nil
+	})
+}
+
+func (ctx *ProxyCtx) getUpstreamTimeout() time.Duration {
+	if ctx.upstreamTimeoutSet {
+		return ctx.upstreamTimeout
+	}
+	return ctx.Proxy.UpstreamTimeout
+}
+
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func (proxy *ProxyHttpServer) timedOut(ctx *ProxyCtx, kind string, format string, argv ...interface{}) {
+	proxy.Metrics.countTimeout(kind)
+	ctx.Warnf(format, argv...)
+}
+
+// timers are stopped when the tunnel of their ctx closes.
+type timers struct {
+	mu   sync.Mutex
+	list []*time.Timer
+	done bool
+}
+
+func (t *timers) add(timer *time.Timer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		timer.Stop()
+		return
+	}
+	t.list = append(t.list, timer)
+}
+
+func (t *timers) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done = true
+	for _, timer := range t.list {
+		timer.Stop()
+	}
+	t.list = nil
+}
+
+// reset rearms timer to fire after d, unless the timers were stopped.
+func (t *timers) reset(timer *time.Timer, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.done {
+		timer.Reset(d)
+	}
+}
+
+// limitLifetime kills the session of ctx after MaxTunnelLifetime.
+func (proxy *ProxyHttpServer) limitLifetime(ctx *ProxyCtx) {
+	d := proxy.MaxTunnelLifetime
+	if d <= 0 {
+		return
+	}
+	ctx.timers.add(time.AfterFunc(d, func() {
+		proxy.timedOut(ctx, "tunnel_lifetime", "Closing tunnel open for more than %v", d)
+		proxy.sessions.kill(ctx.Session)
+	}))
+}
+
+// watchIdle calls closeAll once no bytes went through the tunnel of ctx for
+// TunnelIdleTimeout.
+func (proxy *ProxyHttpServer) watchIdle(ctx *ProxyCtx, closeAll func()) {
+	d := proxy.TunnelIdleTimeout
+	if d <= 0 {
+		return
+	}
+	// armed only once assigned, the callback reads timer
+	var timer *time.Timer
+	timer = time.AfterFunc(math.MaxInt64, func() {
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&ctx.lastActivity)))
+		if idle < d {
+			ctx.timers.reset(timer, d-idle)
+			return
+		}
+		proxy.timedOut(ctx, "tunnel_idle", "Closing tunnel idle for %v", idle)
+		closeAll()
+	})
+	ctx.timers.add(timer)
+	ctx.timers.reset(timer, d)
+}
+
+// setHeaderDeadline limits the wait for the next request in MITM loops to
+// HeaderReadTimeout, and lifts the limit once its headers are read.
+func (proxy *ProxyHttpServer) setHeaderDeadline(c net.Conn, reading bool) {
+	if proxy.HeaderReadTimeout <= 0 {
+		return
+	}
+	if reading {
+		c.SetReadDeadline(time.Now().Add(proxy.HeaderReadTimeout))
+	} else {
+		c.SetReadDeadline(time.Time{})
+	}
+}
+
+// withUpstreamTimeout bounds req by the upstream timeout of ctx. The
+// returned finish must be called with the response or error of the round
+// trip, and cancels once the response body is closed.
+func (ctx *ProxyCtx) withUpstreamTimeout(req *http.Request) (*http.Request, func(*http.Response, error)) {
+	d := ctx.getUpstreamTimeout()
+	if d <= 0 {
+		return req, func(*http.Response, error) {}
+	}
+	c, cancel := context.WithTimeout(req.Context(), d)
+	return req.WithContext(c), func(resp *http.Response, err error) {
+		if err != nil {
+			if c.Err() == context.DeadlineExceeded {
+				ctx.Proxy.timedOut(ctx, "upstream", "Upstream did not answer within %v", d)
+			}
+			cancel()
+			return
+		}
+		if resp == nil {
+			cancel()
+			return
+		}
+		resp.Body = &deadlineBody{ReadCloser: resp.Body, ctx: ctx, c: c, cancel: cancel, d: d}
+	}
+}
+
+type deadlineBody struct {
+	io.ReadCloser
+	ctx    *ProxyCtx
+	c      context.Context
+	cancel context.CancelFunc
+	d      time.Duration
+	once   sync.Once
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.c.Err() == context.DeadlineExceeded {
+		b.once.Do(func() {
+			b.ctx.Proxy.timedOut(b.ctx, "upstream", "Upstream response body not read within %v", b.d)
+		})
+	}
+	return n, err
+}
+
+func (b *deadlineBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
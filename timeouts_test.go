@@ -0,0 +1,135 @@
+package myproxy_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+func expectTimeout(t *testing.T, m *myproxy.Metrics, kind string) {
+	expected := fmt.Sprintf(`myproxy_timeouts_total{kind="%s"} 1`, kind)
+	if out := scrape(t, m); !strings.Contains(out, expected) {
+		t.Errorf("Expected %q in metrics:\n%s", expected, out)
+	}
+}
+
+func expectClosed(t *testing.T, c io.Reader, within time.Duration) {
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, c)
+		done <- err
+	}()
+	select {
+	case <-done:
+	case <-time.After(within):
+		t.Fatal("Expected connection to be closed")
+	}
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.Metrics = myproxy.NewMetrics()
+	proxy.TunnelIdleTimeout = 150 * time.Millisecond
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, _ := connectThrough(t, l, echo.Addr().String())
+	defer c.Close()
+	buf := make([]byte, 4)
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(c, "ping")
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal("Expected active tunnel to stay open, got", err)
+		}
+	}
+	expectClosed(t, c, time.Second)
+	expectTimeout(t, proxy.Metrics, "tunnel_idle")
+}
+
+func TestMaxTunnelLifetime(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.Metrics = myproxy.NewMetrics()
+	proxy.MaxTunnelLifetime = 100 * time.Millisecond
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, _ := connectThrough(t, l, echo.Addr().String())
+	defer c.Close()
+	go func() {
+		for {
+			if _, err := fmt.Fprint(c, "ping"); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	expectClosed(t, c, time.Second)
+	expectTimeout(t, proxy.Metrics, "tunnel_lifetime")
+}
+
+func TestMitmHeaderReadTimeout(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.Metrics = myproxy.NewMetrics()
+	proxy.HeaderReadTimeout = 100 * time.Millisecond
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, _ := connectThrough(t, l, https.Listener.Addr().String())
+	defer c.Close()
+	tlsConn := tls.Client(c, acceptAllCerts)
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, tlsConn, time.Second)
+	expectTimeout(t, proxy.Metrics, "header_read")
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer origin.Close()
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.Metrics = myproxy.NewMetrics()
+	proxy.UpstreamTimeout = 50 * time.Millisecond
+	proxy.OnRequest(myproxy.UrlMatches(regexp.MustCompile("/patient"))).Do(myproxy.UpstreamTimeout(time.Second))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(origin.URL + "/hasty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Error("Expected request to time out, got", resp.Status)
+	}
+	expectTimeout(t, proxy.Metrics, "upstream")
+
+	resp, err = client.Get(origin.URL + "/patient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Error("Expected the longer timeout of the handler, got", resp.Status)
+	}
+}
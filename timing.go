@@ -0,0 +1,164 @@
+package myproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timing is the breakdown of the upstream exchange of a ProxyCtx, or of the
+// dial of a CONNECT. Phases that did not happen are zero, such as DNS for an
+// IP address, or Connect and TLSHandshake when a connection was reused.
+type Timing struct {
+	DNS          time.Duration `json:"dns_ns,omitempty"`
+	Connect      time.Duration `json:"connect_ns,omitempty"`
+	TLSHandshake time.Duration `json:"tls_ns,omitempty"`
+	RequestWrite time.Duration `json:"request_write_ns,omitempty"`
+	FirstByte    time.Duration `json:"first_byte_ns,omitempty"`
+	BodyComplete time.Duration `json:"body_complete_ns,omitempty"`
+	Reused       bool          `json:"reused,omitempty"`
+}
+
+func (t Timing) upstream() time.Duration {
+	return t.DNS + t.Connect + t.TLSHandshake + t.RequestWrite + t.FirstByte
+}
+
+// timings is filled by httptrace hooks, which may run on the transport's
+// goroutines even after RoundTrip returned.
+type timings struct {
+	mu sync.Mutex
+	Timing
+	dnsStart, connectStart, tlsStart time.Time
+	gotConn, wroteRequest, firstByte time.Time
+}
+
+// Timing returns the upstream timing breakdown recorded so far.
+func (ctx *ProxyCtx) Timing() Timing {
+	ctx.timings.mu.Lock()
+	defer ctx.timings.mu.Unlock()
+	return ctx.timings.Timing
+}
+
+func (t *timings) record(f func()) {
+	t.mu.Lock()
+	f()
+	t.mu.Unlock()
+}
+
+func (t *timings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.record(func() { t.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.record(func() { t.DNS = time.Since(t.dnsStart) })
+		},
+		ConnectStart: func(network, addr string) {
+			t.record(func() { t.connectStart = time.Now() })
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.record(func() {
+				if err == nil {
+					t.Connect = time.Since(t.connectStart)
+				}
+			})
+		},
+		TLSHandshakeStart: func() {
+			t.record(func() { t.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.record(func() { t.TLSHandshake = time.Since(t.tlsStart) })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.record(func() { t.gotConn, t.Reused = time.Now(), info.Reused })
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.record(func() {
+				t.wroteRequest = time.Now()
+				t.RequestWrite = t.wroteRequest.Sub(t.gotConn)
+			})
+		},
+		GotFirstResponseByte: func() {
+			t.record(func() {
+				t.firstByte = time.Now()
+				t.FirstByte = t.firstByte.Sub(t.wroteRequest)
+			})
+		},
+	}
+}
+
+func (t *timings) context(c context.Context) context.Context {
+	return httptrace.WithClientTrace(c, t.clientTrace())
+}
+
+func (t *timings) bodyDone() {
+	t.record(func() {
+		if t.BodyComplete == 0 && !t.firstByte.IsZero() {
+			t.BodyComplete = time.Since(t.firstByte)
+		}
+	})
+}
+
+// timedBody records when the upstream response body was read to the end.
+type timedBody struct {
+	io.ReadCloser
+	t *timings
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.t.bodyDone()
+	}
+	return n, err
+}
+
+func timeBody(resp *http.Response, t *timings) {
+	// the body of a 101 is the upgraded connection, which must stay writable
+	if resp != nil && resp.Body != nil && resp.Body != http.NoBody && resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &timedBody{ReadCloser: resp.Body, t: t}
+	}
+}
+
+func formatMillis(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
+
+// serverTiming is the Server-Timing value of ctx's upstream phases, and of
+// the time spent in the proxy itself until now.
+func (ctx *ProxyCtx) serverTiming() string {
+	t := ctx.Timing()
+	var metrics []string
+	for _, m := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"dns", t.DNS},
+		{"connect", t.Connect},
+		{"tls", t.TLSHandshake},
+		{"write", t.RequestWrite},
+		{"ttfb", t.FirstByte},
+	} {
+		if m.d > 0 {
+			metrics = append(metrics, m.name+";dur="+formatMillis(m.d))
+		}
+	}
+	proxy := time.Since(ctx.start) - t.upstream()
+	if proxy < 0 {
+		proxy = 0
+	}
+	metrics = append(metrics, "proxy;dur="+formatMillis(proxy))
+	return strings.Join(metrics, ", ")
+}
+
+func (proxy *ProxyHttpServer) addServerTiming(h http.Header, ctx *ProxyCtx) {
+	if proxy.ServerTiming {
+		h.Add("Server-Timing", ctx.serverTiming())
+	}
+}
@@ -0,0 +1,76 @@
+package myproxy_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+func TestTimingAndServerTiming(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer origin.Close()
+	buf := &syncBuffer{}
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.ServerTiming = true
+	proxy.AccessLog = myproxy.NewAccessLog(buf, myproxy.JSONLogFormat)
+	var inHandler myproxy.Timing
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+		inHandler = ctx.Timing()
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if inHandler.Connect <= 0 || inHandler.FirstByte < 20*time.Millisecond || inHandler.Reused {
+		t.Errorf("Unexpected timing in response handler %+v", inHandler)
+	}
+	st := resp.Header.Get("Server-Timing")
+	for _, metric := range []string{"connect;dur=", "ttfb;dur=", "proxy;dur="} {
+		if !strings.Contains(st, metric) {
+			t.Errorf("Expected %q in Server-Timing %q", metric, st)
+		}
+	}
+
+	var e myproxy.AccessEntry
+	if err := json.Unmarshal([]byte(buf.wait()), &e); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if e.Timing.FirstByte < 20*time.Millisecond || e.Timing.BodyComplete <= 0 {
+		t.Errorf("Expected access log to have the whole timing, got %+v", e.Timing)
+	}
+}
+
+func TestConnectTiming(t *testing.T) {
+	buf := &syncBuffer{}
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.AccessLog = myproxy.NewAccessLog(buf, myproxy.JSONLogFormat)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(https.URL+"/bobo", client, t)
+	client.Transport.(*http.Transport).CloseIdleConnections()
+
+	var e myproxy.AccessEntry
+	if err := json.Unmarshal([]byte(buf.wait()), &e); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if e.Timing.Connect <= 0 {
+		t.Errorf("Expected the dial of the tunnel to be timed, got %+v", e.Timing)
+	}
+}
@@ -0,0 +1,399 @@
+package myproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanKind uses the OTLP values.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Span is one timed phase of a proxied exchange. IDs are lower case hex, as
+// in the traceparent header.
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Kind       SpanKind
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+}
+
+func (s *Span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]interface{})
+	}
+	s.Attributes[key] = value
+}
+
+// SpanExporter gets the spans of every sampled exchange once it completes.
+// It is called from the goroutine serving the exchange, so it should not
+// block.
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+type trace struct {
+	exporter SpanExporter
+	traceID  string
+	flags    string
+	sampled  bool
+	root     *Span
+
+	mu       sync.Mutex
+	spans    []*Span
+	finished bool
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n || strings.Trim(s, "0") == "" {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTraceparent returns the trace id, parent span id and flags of a W3C
+// traceparent header, and ok false when it is missing or invalid.
+func parseTraceparent(h string) (traceID, parentID, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", "", false
+	}
+	if !isHex(parts[1], 32) || !isHex(parts[2], 16) || len(parts[3]) != 2 {
+		return "", "", "", false
+	}
+	if _, err := strconv.ParseUint(parts[3], 16, 8); err != nil {
+		return "", "", "", false
+	}
+	return parts[1], parts[2], parts[3], true
+}
+
+// startTrace joins the trace of the request's traceparent, or the trace of
+// the CONNECT it came through, or else starts a new one.
+func (proxy *ProxyHttpServer) startTrace(req *http.Request, connect *ProxyCtx) *trace {
+	if proxy.SpanExporter == nil || req == nil {
+		return nil
+	}
+	t := &trace{exporter: proxy.SpanExporter, traceID: newID(16), flags: "01", sampled: true}
+	parent := ""
+	if traceID, parentID, flags, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+		t.traceID, parent, t.flags = traceID, parentID, flags
+		f, _ := strconv.ParseUint(flags, 16, 8)
+		t.sampled = f&1 == 1
+	} else if connect != nil && connect.trace != nil {
+		t.traceID, parent, t.flags, t.sampled = connect.trace.traceID, connect.trace.root.SpanID, connect.trace.flags, connect.trace.sampled
+	}
+	t.root = &Span{TraceID: t.traceID, SpanID: newID(8), ParentID: parent, Kind: SpanKindServer, Start: time.Now()}
+	return t
+}
+
+func (t *trace) start(name string, kind SpanKind, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+	if parent == nil {
+		parent = t.root
+	}
+	return &Span{TraceID: t.traceID, SpanID: newID(8), ParentID: parent.SpanID, Name: name, Kind: kind, Start: time.Now()}
+}
+
+func (t *trace) end(s *Span, err error) {
+	if t == nil || s == nil {
+		return
+	}
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.finished {
+		t.spans = append(t.spans, s)
+	}
+}
+
+func (t *trace) traceparent(s *Span) string {
+	return "00-" + t.traceID + "-" + s.SpanID + "-" + t.flags
+}
+
+// finish ends the root span and exports the trace if it is sampled.
+func (t *trace) finish(req *http.Request, status int, err error) error {
+	if t == nil {
+		return nil
+	}
+	t.root.Name = "proxy " + req.Method
+	t.root.set("http.method", req.Method)
+	if req.Method == http.MethodConnect {
+		t.root.set("http.url", req.URL.Host)
+	} else {
+		t.root.set("http.url", req.URL.String())
+	}
+	t.root.set("net.peer.addr", req.RemoteAddr)
+	if status != 0 {
+		t.root.set("http.status_code", status)
+	}
+	t.end(t.root, err)
+	t.mu.Lock()
+	spans := t.spans
+	t.spans, t.finished = nil, true
+	t.mu.Unlock()
+	if !t.sampled {
+		return nil
+	}
+	return t.exporter.ExportSpans(spans)
+}
+
+// context makes the DNS, dial and TLS phases of dials using c children of s.
+func (t *trace) context(c context.Context, s *Span) context.Context {
+	if t == nil || s == nil {
+		return c
+	}
+	return httptrace.WithClientTrace(c, t.clientTrace(s))
+}
+
+// clientTrace records the DNS, dial, TLS and time to first byte phases of
+// an upstream request as children of parent.
+func (t *trace) clientTrace(parent *Span) *httptrace.ClientTrace {
+	var mu sync.Mutex
+	var dns, handshake, ttfb *Span
+	dials := make(map[string]*Span)
+	return &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dns = t.start("dns", SpanKindInternal, parent)
+			dns.set("net.host.name", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			t.end(dns, info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			s := t.start("dial", SpanKindInternal, parent)
+			s.set("net.peer.addr", addr)
+			dials[network+addr] = s
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			t.end(dials[network+addr], err)
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			handshake = t.start("tls", SpanKindInternal, parent)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			handshake.set("tls.server_name", state.ServerName)
+			t.end(handshake, err)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			ttfb = t.start("time to first byte", SpanKindInternal, parent)
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			t.end(ttfb, nil)
+		},
+	}
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP/HTTP in
+// JSON, such as http://localhost:4318/v1/traces. Spans are batched and sent
+// every Interval, or sooner once BatchSize of them are waiting.
+type OTLPExporter struct {
+	Endpoint    string
+	ServiceName string
+	Client      *http.Client
+	Interval    time.Duration
+	BatchSize   int
+	Logger      Logger
+
+	mu      sync.Mutex
+	pending []*Span
+	timer   *time.Timer
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		Endpoint:    endpoint,
+		ServiceName: "myproxy",
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Interval:    5 * time.Second,
+		BatchSize:   512,
+	}
+}
+
+func (e *OTLPExporter) ExportSpans(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending = append(e.pending, spans...)
+	if len(e.pending) >= e.BatchSize {
+		batch := e.pending
+		e.pending = nil
+		go func() { e.report(e.send(batch)) }()
+	} else if e.timer == nil {
+		e.timer = time.AfterFunc(e.Interval, func() { e.report(e.Flush()) })
+	}
+	return nil
+}
+
+func (e *OTLPExporter) report(err error) {
+	if err != nil && e.Logger != nil {
+		e.Logger.Printf("Cannot export spans: %v", err)
+	}
+}
+
+// Flush sends the spans waiting for the next batch.
+func (e *OTLPExporter) Flush() error {
+	e.mu.Lock()
+	batch := e.pending
+	e.pending = nil
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	e.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	return e.send(batch)
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	var out []otlpAttribute
+	for k, v := range attrs {
+		var value otlpValue
+		switch v := v.(type) {
+		case string:
+			value.StringValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case bool:
+			value.BoolValue = &v
+		case float64:
+			value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		out = append(out, otlpAttribute{Key: k, Value: value})
+	}
+	return out
+}
+
+func (e *OTLPExporter) send(batch []*Span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Error != "" {
+			spans[i].Status = &otlpStatus{Code: 2, Message: s.Error}
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": e.ServiceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/fj9140/myproxy"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package myproxy_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fj9140/myproxy"
+)
+
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+}
+
+type collector struct {
+	*httptest.Server
+	mu    sync.Mutex
+	spans map[string]otlpSpan
+}
+
+func newCollector() *collector {
+	c := &collector{spans: make(map[string]otlpSpan)}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			http.Error(w, "bad export", 400)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					c.spans[s.Name] = s
+				}
+			}
+		}
+	}))
+	return c
+}
+
+func (c *collector) span(name string) (otlpSpan, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.spans[name]
+	return s, ok
+}
+
+// wait flushes exporter until the span called name arrives, as the proxy
+// finishes a trace after the client got the whole response.
+func (c *collector) wait(exporter *myproxy.OTLPExporter, name string) (otlpSpan, bool) {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		exporter.Flush()
+		if s, ok := c.span(name); ok {
+			return s, ok
+		}
+	}
+	return c.span(name)
+}
+
+func traceparentEcho() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("traceparent")))
+	}))
+}
+
+const incomingTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+func TestTracing(t *testing.T) {
+	col := newCollector()
+	defer col.Close()
+	origin := traceparentEcho()
+	defer origin.Close()
+	exporter := myproxy.NewOTLPExporter(col.URL + "/v1/traces")
+	exporter.Interval = time.Hour
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.SpanExporter = exporter
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	req, _ := http.NewRequest("GET", origin.URL+"/traced", nil)
+	req.Header.Set("traceparent", "00-"+incomingTraceID+"-00f067aa0ba902b7-01")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	root, ok := col.wait(exporter, "proxy GET")
+	if !ok || root.TraceID != incomingTraceID || root.ParentSpanID != "00f067aa0ba902b7" {
+		t.Fatalf("Expected the proxy span to join the incoming trace, got %+v", root)
+	}
+	upstream, _ := col.span("upstream GET")
+	if expected := "00-" + incomingTraceID + "-" + upstream.SpanID + "-01"; string(b) != expected {
+		t.Errorf("Expected origin to get traceparent %q, got %q", expected, b)
+	}
+	for _, name := range []string{"request handlers", "dial", "time to first byte", "response handlers", "copy body"} {
+		s, ok := col.span(name)
+		if !ok {
+			t.Errorf("Expected a %q span, got %v", name, col.spans)
+			continue
+		}
+		if s.TraceID != incomingTraceID {
+			t.Errorf("Expected %q span in the incoming trace, got %+v", name, s)
+		}
+	}
+	if dial, _ := col.span("dial"); dial.ParentSpanID != upstream.SpanID {
+		t.Errorf("Expected dial to be a child of the upstream request, got %+v", dial)
+	}
+}
+
+func TestTracingMitmTLS(t *testing.T) {
+	col := newCollector()
+	defer col.Close()
+	exporter := myproxy.NewOTLPExporter(col.URL + "/v1/traces")
+	exporter.Interval = time.Hour
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.SpanExporter = exporter
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(https.URL+"/bobo", client, t)
+
+	get, ok := col.wait(exporter, "proxy GET")
+	if !ok {
+		t.Fatal("Expected a span for the MITM'd request")
+	}
+	if _, ok := col.span("tls"); !ok {
+		t.Error("Expected a span for the TLS handshake with the origin")
+	}
+	if connect, ok := col.span("proxy CONNECT"); ok && (connect.TraceID != get.TraceID || get.ParentSpanID != connect.SpanID) {
+		t.Errorf("Expected MITM'd request %+v to be a child of %+v", get, connect)
+	}
+}
+
+func TestTracingNotSampled(t *testing.T) {
+	col := newCollector()
+	defer col.Close()
+	origin := traceparentEcho()
+	defer origin.Close()
+	exporter := myproxy.NewOTLPExporter(col.URL + "/v1/traces")
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.SpanExporter = exporter
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("traceparent", "00-"+incomingTraceID+"-00f067aa0ba902b7-00")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	col.wait(exporter, "proxy GET")
+
+	if got := string(b); !strings.HasPrefix(got, "00-"+incomingTraceID+"-") || !strings.HasSuffix(got, "-00") {
+		t.Errorf("Expected the unsampled trace to be propagated, got %q", got)
+	}
+	if len(col.spans) != 0 {
+		t.Errorf("Expected no spans for an unsampled trace, got %v", col.spans)
+	}
+}
@@ -0,0 +1,261 @@
+package myproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Upstream describes where a request or a CONNECT tunnel is forwarded to.
+// A nil URL means the destination is dialed directly. Hosts matched by
+// NoProxy (same syntax as the NO_PROXY environment variable) bypass the
+// upstream proxy on both the plain HTTP and the CONNECT paths. With HTTP2
+// set, tunnels through an https:// upstream are multiplexed as HTTP/2
+// CONNECT streams.
+type Upstream struct {
+	URL     *url.URL
+	NoProxy string
+	Auth    *ProxyAuth
+	HTTP2   bool
+
+	once    sync.Once
+	noProxy noProxyList
+}
+
+var DirectUpstream = &Upstream{}
+
+func NewUpstream(proxyURL string) (*Upstream, error) {
+	if proxyURL == "" {
+		return &Upstream{}, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, errors.New("unsupported upstream proxy scheme " + u.Scheme)
+	}
+	upstream := &Upstream{URL: u}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		upstream.Auth = &ProxyAuth{Username: u.User.Username(), Password: pass, Preemptive: true}
+	}
+	return upstream, nil
+}
+
+func (u *Upstream) String() string {
+	if u.URL == nil {
+		return "direct"
+	}
+	return u.URL.Redacted()
+}
+
+func (u *Upstream) bypass(addr string) bool {
+	u.once.Do(func() {
+		u.noProxy = parseNoProxy(u.NoProxy)
+	})
+	return u.URL == nil || u.noProxy.match(addr)
+}
+
+func (u *Upstream) proxyFunc(req *http.Request) (*url.URL, error) {
+	addr := req.URL.Host
+	if !hasPort.MatchString(addr) {
+		if req.URL.Scheme == "https" {
+			addr += ":443"
+		} else {
+			addr += ":80"
+		}
+	}
+	if u.bypass(addr) {
+		return nil, nil
+	}
+	return u.URL, nil
+}
+
+type upstreamRoute struct {
+	conds    []ReqCondition
+	upstream *Upstream
+}
+
+func (pcond *ReqProxyConds) RouteTo(u *Upstream) {
+	r := &pcond.proxy.rules
+	r.change(func() { r.routes = append(r.routes, upstreamRoute{pcond.reqConds, u}) })
+}
+
+func (pcond *ReqProxyConds) RouteToURL(proxyURL string) error {
+	u, err := NewUpstream(proxyURL)
+	if err != nil {
+		return err
+	}
+	pcond.RouteTo(u)
+	return nil
+}
+
+func (proxy *ProxyHttpServer) upstreamFor(req *http.Request, ctx *ProxyCtx) *Upstream {
+	for _, route := range ctx.handlers().routes {
+		matched := true
+		for _, cond := range route.conds {
+			if !cond.HandleReq(req, ctx) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return route.upstream
+		}
+	}
+	return nil
+}
+
+func (proxy *ProxyHttpServer) upstreamTransport(u *Upstream) http.RoundTripper {
+	proxy.upstreamMu.Lock()
+	defer proxy.upstreamMu.Unlock()
+	if proxy.upstreamTransports == nil {
+		proxy.upstreamTransports = make(map[*Upstream]http.RoundTripper)
+	}
+	tr, ok := proxy.upstreamTransports[u]
+	if !ok {
+		if u.URL != nil && u.Auth != nil && (u.URL.Scheme == "http" || u.URL.Scheme == "https") {
+			tr = proxy.newProxyAuthTransport(u)
+		} else if u.URL != nil && (u.URL.Scheme == "socks5" || u.URL.Scheme == "socks5h") {
+			// net/http always lets socks proxies resolve names, dial
+			// through dialSocks5 to honor socks5:// resolving them here
+			clone := proxy.Tr.Clone()
+			clone.Proxy = nil
+			clone.DialContext = func(c context.Context, network, addr string) (net.Conn, error) {
+				return proxy.upstreamDial(c, u, network, addr)
+			}
+			tr = clone
+		} else {
+			clone := proxy.Tr.Clone()
+			clone.Proxy = u.proxyFunc
+			tr = clone
+		}
+		proxy.upstreamTransports[u] = tr
+	}
+	return tr
+}
+
+func (proxy *ProxyHttpServer) upstreamDial(c context.Context, u *Upstream, network, addr string) (net.Conn, error) {
+	if u.bypass(addr) {
+		return proxy.dialContext(c, network, addr)
+	}
+	proxy.upstreamMu.Lock()
+	if proxy.upstreamDialers == nil {
+		proxy.upstreamDialers = make(map[*Upstream]dialContextFunc)
+	}
+	dial, ok := proxy.upstreamDialers[u]
+	if !ok {
+		switch u.URL.Scheme {
+		case "socks5", "socks5h":
+			proxyURL := u.URL
+			dial = func(c context.Context, network, addr string) (net.Conn, error) {
+				return proxy.dialSocks5(c, proxyURL, network, addr)
+			}
+		case "https":
+			if u.HTTP2 {
+				dial = proxy.newConnectDialToProxyH2(u.URL.String(), u.Auth)
+			} else {
+				dial = proxy.newConnectDialToProxy(u.URL.String(), nil, u.Auth)
+			}
+		default:
+			dial = proxy.newConnectDialToProxy(u.URL.String(), nil, u.Auth)
+		}
+		proxy.upstreamDialers[u] = dial
+	}
+	proxy.upstreamMu.Unlock()
+	if dial == nil {
+		return nil, errors.New("cannot dial through upstream proxy " + u.String())
+	}
+	return dial(c, network, addr)
+}
+
+type noProxyEntry struct {
+	ipnet  *net.IPNet
+	ip     net.IP
+	domain string
+	suffix bool
+	port   string
+}
+
+type noProxyList struct {
+	all     bool
+	entries []noProxyEntry
+}
+
+func parseNoProxy(s string) noProxyList {
+	var l noProxyList
+	for _, p := range strings.Split(s, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			l.all = true
+			return l
+		}
+		if _, ipnet, err := net.ParseCIDR(p); err == nil {
+			l.entries = append(l.entries, noProxyEntry{ipnet: ipnet})
+			continue
+		}
+		var e noProxyEntry
+		if host, port, err := net.SplitHostPort(p); err == nil {
+			p, e.port = host, port
+		}
+		p = strings.Trim(p, "[]")
+		if ip := net.ParseIP(p); ip != nil {
+			e.ip = ip
+			l.entries = append(l.entries, e)
+			continue
+		}
+		if strings.HasPrefix(p, "*.") {
+			p = p[1:]
+		}
+		e.suffix = strings.HasPrefix(p, ".")
+		e.domain = strings.TrimPrefix(strings.TrimSuffix(p, "."), ".")
+		l.entries = append(l.entries, e)
+	}
+	return l
+}
+
+func (l noProxyList) match(addr string) bool {
+	if l.all {
+		return true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ip := net.ParseIP(host)
+	for _, e := range l.entries {
+		if e.port != "" && e.port != port {
+			continue
+		}
+		switch {
+		case e.ipnet != nil:
+			if ip != nil && e.ipnet.Contains(ip) {
+				return true
+			}
+		case e.ip != nil:
+			if ip != nil && e.ip.Equal(ip) {
+				return true
+			}
+		case e.suffix:
+			if strings.HasSuffix(host, "."+e.domain) {
+				return true
+			}
+		default:
+			if host == e.domain || strings.HasSuffix(host, "."+e.domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package myproxy_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/fj9140/myproxy"
+)
+
+func doublingProxy(t *testing.T) *myproxy.ProxyHttpServer {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *myproxy.ProxyCtx) *http.Response {
+		b, err := ioutil.ReadAll(resp.Body)
+		panicOnErr(err, "readAll resp")
+		resp.Body = ioutil.NopCloser(bytes.NewBufferString(string(b) + " " + string(b)))
+		return resp
+	})
+	return proxy
+}
+
+func TestCtxRoundTripperIsHonored(t *testing.T) {
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(myproxy.AlwaysMitm)
+	proxy.OnRequest(myproxy.UrlIs("/momo")).DoFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.RoundTripper = myproxy.RoundTripperFunc(func(req *http.Request, ctx *myproxy.ProxyCtx) (*http.Response, error) {
+			return myproxy.NewResponse(req, myproxy.ContentTypeText, http.StatusOK, "koko"), nil
+		})
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(srv.URL+"/momo", client, t)); r != "koko" {
+		t.Error("Expected ctx.RoundTripper to answer koko, got", r)
+	}
+	if r := string(getOrFail(https.URL+"/momo", client, t)); r != "koko" {
+		t.Error("Expected ctx.RoundTripper to answer koko when mitm, got", r)
+	}
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected default transport for /bobo, got", r)
+	}
+}
+
+func TestRouteToUpstreamProxy(t *testing.T) {
+	_, upstream := oneShotProxy(doublingProxy(t), t)
+	defer upstream.Close()
+
+	proxy := myproxy.NewProxyHttpServer()
+	if err := proxy.OnRequest(myproxy.UrlIs("/bobo")).RouteToURL(upstream.URL); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(srv.URL)
+	proxy.OnRequest(myproxy.ReqHostIs(u.Host)).RouteTo(myproxy.DirectUpstream)
+	proxy.OnRequest().RouteToURL(upstream.URL)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "bobo bobo" {
+		t.Error("Expected http request to go through upstream, got", r)
+	}
+	if r := string(getOrFail(srv.URL+"/query?result=bar", client, t)); r != "bar" {
+		t.Error("Expected http request to go direct, got", r)
+	}
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo bobo" {
+		t.Error("Expected CONNECT to go through upstream, got", r)
+	}
+}
+
+func TestRouteToUpstreamNoProxy(t *testing.T) {
+	_, upstream := oneShotProxy(doublingProxy(t), t)
+	defer upstream.Close()
+
+	u, err := myproxy.NewUpstream(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.NoProxy = "example.com, 127.0.0.0/8"
+	proxy := myproxy.NewProxyHttpServer()
+	proxy.OnRequest().RouteTo(u)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected NO_PROXY host to bypass upstream for http, got", r)
+	}
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected NO_PROXY host to bypass upstream for CONNECT, got", r)
+	}
+}
+
+func serveSocks5(t *testing.T, l net.Listener, hosts chan<- string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			buf := make([]byte, 262)
+			if _, err := io.ReadFull(c, buf[:2]); err != nil {
+				return
+			}
+			io.ReadFull(c, buf[:buf[1]])
+			c.Write([]byte{5, 0})
+			if _, err := io.ReadFull(c, buf[:4]); err != nil {
+				return
+			}
+			var host string
+			switch buf[3] {
+			case 1:
+				io.ReadFull(c, buf[:4])
+				host = net.IP(buf[:4]).String()
+			case 4:
+				io.ReadFull(c, buf[:16])
+				host = net.IP(buf[:16]).String()
+			case 3:
+				io.ReadFull(c, buf[:1])
+				n := int(buf[0])
+				io.ReadFull(c, buf[:n])
+				host = string(buf[:n])
+			default:
+				t.Error("unexpected socks5 address type", buf[3])
+				return
+			}
+			if hosts != nil {
+				hosts <- host
+			}
+			io.ReadFull(c, buf[:2])
+			port := int(buf[0])<<8 | int(buf[1])
+			target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+			if err != nil {
+				c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer target.Close()
+			c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			go io.Copy(target, c)
+			io.Copy(c, target)
+		}()
+	}
+}
+
+func TestRouteToSocks5(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	defer l.Close()
+	go serveSocks5(t, l, nil)
+
+	proxy := myproxy.NewProxyHttpServer()
+	if err := proxy.OnRequest().RouteToURL("socks5://" + l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected CONNECT through socks5 to return bobo, got", r)
+	}
+}
+
+func TestSocks5Resolution(t *testing.T) {
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	for scheme, resolved := range map[string]bool{"socks5": true, "socks5h": false} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		panicOnErr(err, "listen")
+		hosts := make(chan string, 1)
+		go serveSocks5(t, l, hosts)
+
+		proxy := myproxy.NewProxyHttpServer()
+		if err := proxy.OnRequest().RouteToURL(scheme + "://" + l.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		client, s := oneShotProxy(proxy, t)
+		if r := string(getOrFail("http://localhost:"+port+"/bobo", client, t)); r != "bobo" {
+			t.Errorf("Expected a request through %s to return bobo, got %s", scheme, r)
+		}
+		if host := <-hosts; (net.ParseIP(host) != nil) != resolved || (!resolved && host != "localhost") {
+			t.Errorf("Expected %s to send a resolved address %v, got %s", scheme, resolved, host)
+		}
+		s.Close()
+		l.Close()
+	}
+}
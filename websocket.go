@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 )
 
 func headerContains(header http.Header, name string, value string) bool {
@@ -66,6 +67,7 @@ func (proxy *ProxyHttpServer) serveWebsocket(ctx *ProxyCtx, w http.ResponseWrite
 	targetConn, err := proxy.connectDial(ctx, "tcp", targetURL.Host)
 	if err != nil {
 		ctx.Warnf("Error dialing target site %v", err)
+		proxy.complete(ctx, proxy.writeError(w, ctx, err), 0)
 		return
 	}
 	defer targetConn.Close()
@@ -80,10 +82,28 @@ func (proxy *ProxyHttpServer) serveWebsocket(ctx *ProxyCtx, w http.ResponseWrite
 		return
 	}
 
+	ctx.status = http.StatusBadGateway
+	clientConn = proxy.trackConn(clientConn, ctx, func() {
+		ctx.timers.stop()
+		proxy.complete(ctx, ctx.status, atomic.LoadInt64(&ctx.bytesOut))
+	})
+	proxy.sessions.onKill(ctx, func() {
+		clientConn.Close()
+		targetConn.Close()
+	})
+	tracked := clientConn
+	if clientConn = proxy.filterTunnel(clientConn, ctx); clientConn == nil {
+		proxy.abortTunnel(tracked, ctx)
+		return
+	}
+	proxy.limitLifetime(ctx)
+	defer clientConn.Close()
+
 	if err := proxy.websocketHandshake(ctx, req, targetConn, clientConn); err != nil {
 		ctx.Warnf("Websocket handshake error: %v", err)
 		return
 	}
+	ctx.status = http.StatusSwitchingProtocols
 
 	proxy.proxyWebsocket(ctx, targetConn, clientConn)
 